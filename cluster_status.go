@@ -0,0 +1,230 @@
+package clusterctl
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ClusterStatus represents the status of a rabbitmq cluster, as seen from a
+// single node.
+type ClusterStatus struct {
+	// The name of the cluster.
+	Name string `json:"name" yaml:"name"`
+
+	// The nodes in the cluster that store their state on disc.
+	DiscNodes []string `json:"disc_nodes" yaml:"disc_nodes"`
+
+	// The nodes in the cluster that only store their state in RAM.
+	RAMNodes []string `json:"ram_nodes" yaml:"ram_nodes"`
+
+	// The nodes in the cluster that are currently running.
+	RunningNodes []string `json:"running_nodes" yaml:"running_nodes"`
+
+	// Network partitions, keyed by node. Each value is the list of nodes
+	// that the node is partitioned from.
+	Partitions map[string][]string `json:"partitions" yaml:"partitions"`
+
+	// Alarms that are currently in effect.
+	Alarms []Alarm `json:"alarms" yaml:"alarms"`
+}
+
+// Alarm represents a resource alarm on a node.
+type Alarm struct {
+	Node string `json:"node" yaml:"node"`
+
+	// The resource that triggered the alarm (e.g. "memory", "disk").
+	Resource string `json:"resource" yaml:"resource"`
+}
+
+// Nodes returns all of the nodes in the cluster.
+func (s *ClusterStatus) Nodes() []string {
+	var nodes []string
+	nodes = append(nodes, s.DiscNodes...)
+	nodes = append(nodes, s.RAMNodes...)
+	return nodes
+}
+
+// IsMember returns true if the node is a member of the cluster.
+func (s *ClusterStatus) IsMember(node string) bool {
+	return contains(s.Nodes(), node)
+}
+
+// IsRunning returns true if the node is running.
+func (s *ClusterStatus) IsRunning(node string) bool {
+	return contains(s.RunningNodes, node)
+}
+
+// IsDisc returns true if the node is a disc node.
+func (s *ClusterStatus) IsDisc(node string) bool {
+	return contains(s.DiscNodes, node)
+}
+
+// Partitioned returns true if there are any network partitions.
+func (s *ClusterStatus) Partitioned() bool {
+	for _, nodes := range s.Partitions {
+		if len(nodes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeAlarms returns the alarms that are in effect on the given node.
+func (s *ClusterStatus) NodeAlarms(node string) []Alarm {
+	var alarms []Alarm
+	for _, a := range s.Alarms {
+		if a.Node == node {
+			alarms = append(alarms, a)
+		}
+	}
+	return alarms
+}
+
+// clusterStatus invokes `rabbitmqctl cluster_status` against the node and
+// parses the result. The json formatter is preferred, but older versions of
+// rabbitmqctl that don't support it will fall back to parsing erlang terms.
+func clusterStatus(rabbitmqctl rabbitmqctlFunc, node string) (*ClusterStatus, error) {
+	out, err := rabbitmqctl(node, "cluster_status", "--formatter", "json")
+	if err != nil {
+		if isConnectionError(err) {
+			return nil, err
+		}
+
+		out, err = rabbitmqctl(node, "cluster_status")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseClusterStatus(out)
+}
+
+var errInvalidClusterStatus = errors.New("unable to parse cluster_status output")
+
+// parseClusterStatus parses the output of `rabbitmqctl cluster_status`, in
+// either json or erlang term format.
+func parseClusterStatus(out string) (*ClusterStatus, error) {
+	if i := strings.IndexAny(out, "{["); i >= 0 {
+		switch out[i] {
+		case '{':
+			return parseClusterStatusJSON(out[i:])
+		case '[':
+			return parseClusterStatusTerm(out[i:])
+		}
+	}
+
+	return nil, errInvalidClusterStatus
+}
+
+// clusterStatusJSON is the format returned by `rabbitmqctl cluster_status
+// --formatter json`.
+type clusterStatusJSON struct {
+	ClusterName  string          `json:"cluster_name"`
+	DiskNodes    []string        `json:"disk_nodes"`
+	RAMNodes     []string        `json:"ram_nodes"`
+	RunningNodes []string        `json:"running_nodes"`
+	Partitions   json.RawMessage `json:"partitions"`
+	Alarms       []struct {
+		Node     string `json:"node"`
+		Type     string `json:"type"`
+		Resource string `json:"resource"`
+	} `json:"alarms"`
+}
+
+func parseClusterStatusJSON(out string) (*ClusterStatus, error) {
+	var raw clusterStatusJSON
+	if err := json.NewDecoder(strings.NewReader(out)).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	s := &ClusterStatus{
+		Name:         raw.ClusterName,
+		DiscNodes:    raw.DiskNodes,
+		RAMNodes:     raw.RAMNodes,
+		RunningNodes: raw.RunningNodes,
+		Partitions:   make(map[string][]string),
+	}
+
+	// When there are no partitions, this can be encoded as an empty list
+	// rather than an empty object.
+	if len(raw.Partitions) > 0 && raw.Partitions[0] == '{' {
+		if err := json.Unmarshal(raw.Partitions, &s.Partitions); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range raw.Alarms {
+		resource := a.Resource
+		if resource == "" {
+			resource = a.Type
+		}
+		s.Alarms = append(s.Alarms, Alarm{Node: a.Node, Resource: resource})
+	}
+
+	return s, nil
+}
+
+func parseClusterStatusTerm(out string) (*ClusterStatus, error) {
+	term, err := parseTerm(out)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := term.([]interface{}); !ok {
+		return nil, errInvalidClusterStatus
+	}
+
+	s := &ClusterStatus{
+		Partitions: make(map[string][]string),
+	}
+
+	if nodes, ok := proplist(term, "nodes"); ok {
+		disc, _ := proplist(nodes, "disc")
+		s.DiscNodes = termStrings(disc)
+		ram, _ := proplist(nodes, "ram")
+		s.RAMNodes = termStrings(ram)
+	}
+
+	running, _ := proplist(term, "running_nodes")
+	s.RunningNodes = termStrings(running)
+
+	if name, ok := proplist(term, "cluster_name"); ok {
+		s.Name, _ = termString(name)
+	}
+
+	// [{Node, [PartitionedNode]}]
+	partitions, _ := proplist(term, "partitions")
+	for _, e := range asList(partitions) {
+		if t, ok := e.(tuple); ok && len(t) == 2 {
+			node, _ := termString(t[0])
+			s.Partitions[node] = termStrings(t[1])
+		}
+	}
+
+	// [{Node, [Alarm]}], where each alarm is either an atom (e.g. memory)
+	// or a tuple like {resource_limit, memory, Node}.
+	alarms, _ := proplist(term, "alarms")
+	for _, e := range asList(alarms) {
+		t, ok := e.(tuple)
+		if !ok || len(t) != 2 {
+			continue
+		}
+
+		node, _ := termString(t[0])
+		for _, a := range asList(t[1]) {
+			if resource, ok := alarmResource(a); ok {
+				s.Alarms = append(s.Alarms, Alarm{Node: node, Resource: resource})
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func alarmResource(term interface{}) (string, bool) {
+	if t, ok := term.(tuple); ok && len(t) >= 2 {
+		return termString(t[1])
+	}
+	return termString(term)
+}
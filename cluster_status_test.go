@@ -0,0 +1,139 @@
+package clusterctl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const clusterStatusJSONOutput = `{"alarms":[{"node":"rabbit@b","resource":"disk","type":"resource_limit"}],"cluster_name":"rabbit@a.example.com","disk_nodes":["rabbit@a","rabbit@b"],"feature_flags":[],"partitions":{"rabbit@a":["rabbit@c"]},"ram_nodes":["rabbit@c"],"running_nodes":["rabbit@b","rabbit@a"]}`
+
+const clusterStatusTermOutput = `Cluster status of node 'rabbit@ip-1-2-3-4' ...
+[{nodes,[{disc,['rabbit@ip-1-2-3-4',rabbit@b]},{ram,[rabbit@c]}]},
+ {running_nodes,[rabbit@b,'rabbit@ip-1-2-3-4']},
+ {cluster_name,<<"rabbit@ip-1-2-3-4.ec2.internal">>},
+ {partitions,[{rabbit@b,[rabbit@c]}]},
+ {alarms,[{rabbit@b,[memory]},{'rabbit@ip-1-2-3-4',[{resource_limit,disk,'rabbit@ip-1-2-3-4'}]}]}]
+...done.
+`
+
+func TestParseClusterStatus(t *testing.T) {
+	tests := []struct {
+		out    string
+		status *ClusterStatus
+	}{
+		{
+			clusterStatusJSONOutput,
+			&ClusterStatus{
+				Name:         "rabbit@a.example.com",
+				DiscNodes:    []string{"rabbit@a", "rabbit@b"},
+				RAMNodes:     []string{"rabbit@c"},
+				RunningNodes: []string{"rabbit@b", "rabbit@a"},
+				Partitions:   map[string][]string{"rabbit@a": {"rabbit@c"}},
+				Alarms:       []Alarm{{Node: "rabbit@b", Resource: "disk"}},
+			},
+		},
+		{
+			`{"alarms":[],"cluster_name":"rabbit@a","disk_nodes":["rabbit@a"],"partitions":[],"ram_nodes":[],"running_nodes":["rabbit@a"]}`,
+			&ClusterStatus{
+				Name:         "rabbit@a",
+				DiscNodes:    []string{"rabbit@a"},
+				RAMNodes:     []string{},
+				RunningNodes: []string{"rabbit@a"},
+				Partitions:   map[string][]string{},
+			},
+		},
+		{
+			clusterStatusTermOutput,
+			&ClusterStatus{
+				Name:         "rabbit@ip-1-2-3-4.ec2.internal",
+				DiscNodes:    []string{"rabbit@ip-1-2-3-4", "rabbit@b"},
+				RAMNodes:     []string{"rabbit@c"},
+				RunningNodes: []string{"rabbit@b", "rabbit@ip-1-2-3-4"},
+				Partitions:   map[string][]string{"rabbit@b": {"rabbit@c"}},
+				Alarms: []Alarm{
+					{Node: "rabbit@b", Resource: "memory"},
+					{Node: "rabbit@ip-1-2-3-4", Resource: "disk"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		status, err := parseClusterStatus(tt.out)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.status, status)
+	}
+}
+
+func TestParseClusterStatus_Invalid(t *testing.T) {
+	_, err := parseClusterStatus("Error: something went wrong")
+	assert.Equal(t, errInvalidClusterStatus, err)
+}
+
+func TestClusterStatus(t *testing.T) {
+	s := &ClusterStatus{
+		DiscNodes:    []string{"rabbit@a"},
+		RAMNodes:     []string{"rabbit@b"},
+		RunningNodes: []string{"rabbit@a"},
+		Partitions:   map[string][]string{"rabbit@a": {}},
+		Alarms:       []Alarm{{Node: "rabbit@a", Resource: "memory"}},
+	}
+
+	assert.Equal(t, []string{"rabbit@a", "rabbit@b"}, s.Nodes())
+	assert.True(t, s.IsMember("rabbit@b"))
+	assert.False(t, s.IsMember("rabbit@c"))
+	assert.True(t, s.IsRunning("rabbit@a"))
+	assert.False(t, s.IsRunning("rabbit@b"))
+	assert.True(t, s.IsDisc("rabbit@a"))
+	assert.False(t, s.IsDisc("rabbit@b"))
+	assert.False(t, s.Partitioned())
+	assert.Equal(t, []Alarm{{Node: "rabbit@a", Resource: "memory"}}, s.NodeAlarms("rabbit@a"))
+	assert.Nil(t, s.NodeAlarms("rabbit@b"))
+}
+
+func TestMembershipController_ClusterStatus(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", []string{"--formatter", "json"}).Return(clusterStatusJSONOutput, nil)
+
+	status, err := c.ClusterStatus("rabbit@a")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@a.example.com", status.Name)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ClusterStatus_Fallback(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", []string{"--formatter", "json"}).Return("", &RabbitmqCtlError{Err: ErrCommandNotFound})
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", emptyArgs).Return(clusterStatusTermOutput, nil)
+
+	status, err := c.ClusterStatus("rabbit@a")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-1-2-3-4.ec2.internal", status.Name)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ClusterStatus_NodeDown(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", []string{"--formatter", "json"}).Return("", &RabbitmqCtlError{Err: ErrNodeDown})
+
+	_, err := c.ClusterStatus("rabbit@a")
+	assert.True(t, errors.Is(err, ErrNodeDown))
+
+	m.AssertExpectations(t)
+}
@@ -1,17 +1,284 @@
 package clusterctl
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 )
 
-type rabbitmqctlFunc func(node string, command string, arg ...string) error
+type rabbitmqctlFunc func(node string, command string, arg ...string) (string, error)
 
-// rabbitmqctl is a function that invokes the rabbitmqctl command using the exec
-// package.
-func rabbitmqctl(node string, command string, arg ...string) error {
-	cmd := exec.Command("rabbitmqctl", append([]string{command}, arg...)...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// DefaultRabbitmqCtl is a RabbitmqCtl that invokes the rabbitmqctl command found
+// in $PATH.
+var DefaultRabbitmqCtl = &RabbitmqCtl{}
+
+// DefaultTimeout is the default amount of time that a single invocation of
+// rabbitmqctl is allowed to run for.
+const DefaultTimeout = 5 * time.Minute
+
+// Errors that can be returned (wrapped in a RabbitmqCtlError) when rabbitmqctl
+// fails.
+var (
+	ErrNodeDown        = errors.New("node is down")
+	ErrNodeUnreachable = errors.New("node is unreachable")
+	ErrBadCookie       = errors.New("erlang cookie was rejected by the node")
+	ErrCommandNotFound = errors.New("command not found")
+	ErrUsage           = errors.New("invalid usage")
+	ErrTimeout         = errors.New("timed out")
+)
+
+// Exit codes returned by rabbitmqctl. See
+// https://www.rabbitmq.com/cli.html#exit-codes
+const (
+	exitUsage       = 64
+	exitUnavailable = 69
+	exitTempFail    = 75
+
+	// Older, erlang based, versions of rabbitmqctl exit with 2 when they
+	// can't connect to the node.
+	exitLegacyNodeDown = 2
+)
+
+// Result is the result of invoking rabbitmqctl.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// RabbitmqCtlError is returned when rabbitmqctl fails.
+type RabbitmqCtlError struct {
+	// The node that rabbitmqctl was invoked against.
+	Node string
+
+	// The rabbitmqctl command that was invoked (e.g. "join_cluster").
+	Command string
+
+	// The result of invoking rabbitmqctl. This will be nil if rabbitmqctl
+	// could not be started.
+	Result *Result
+
+	// The underlying error. When the failure could be classified, this
+	// will be one of ErrNodeDown, ErrNodeUnreachable, ErrBadCookie,
+	// ErrCommandNotFound, ErrUsage or ErrTimeout.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *RabbitmqCtlError) Error() string {
+	msg := fmt.Sprintf("rabbitmqctl %s on %s: %v", e.Command, e.Node, e.Err)
+
+	if e.Result != nil {
+		if stderr := strings.TrimSpace(e.Result.Stderr); stderr != "" {
+			msg = fmt.Sprintf("%s: %s", msg, stderr)
+		}
+	}
+
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *RabbitmqCtlError) Unwrap() error {
+	return e.Err
+}
+
+// RabbitmqCtl invokes the rabbitmqctl command against a specific node.
+type RabbitmqCtl struct {
+	// Path to the rabbitmqctl binary. The default is to look up
+	// "rabbitmqctl" in $PATH.
+	Path string
+
+	// When true, --longnames is passed to rabbitmqctl, which is required
+	// when nodes are using fully qualified hostnames.
+	Longnames bool
+
+	// Path to a file containing the erlang cookie to use when connecting to
+	// the node. The cookie is passed to rabbitmqctl in the
+	// RABBITMQ_ERLANG_COOKIE environment variable, so that it isn't visible
+	// in the process list. The default is to let rabbitmqctl find the
+	// cookie itself.
+	CookieFile string
+
+	// The maximum amount of time that a single invocation of rabbitmqctl
+	// can take when using Run. The default is DefaultTimeout.
+	Timeout time.Duration
+
+	// function to execute to run the command, with env added to the
+	// environment. The default is to use the exec package.
+	exec func(ctx context.Context, env []string, name string, arg ...string) (*Result, error)
+}
+
+// Run invokes rabbitmqctl against the given node, returning stdout. The command
+// is killed if it takes longer than the configured Timeout.
+func (r *RabbitmqCtl) Run(node string, command string, arg ...string) (string, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := r.Exec(ctx, node, command, arg...)
+	if result == nil {
+		return "", err
+	}
+
+	return result.Stdout, err
+}
+
+// Exec invokes rabbitmqctl against the given node, capturing its output. If
+// rabbitmqctl fails, the returned error will be a *RabbitmqCtlError. The
+// command is killed if the context is cancelled or its deadline expires.
+func (r *RabbitmqCtl) Exec(ctx context.Context, node string, command string, arg ...string) (*Result, error) {
+	var env []string
+	if r.CookieFile != "" {
+		raw, err := ioutil.ReadFile(r.CookieFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "RABBITMQ_ERLANG_COOKIE="+strings.TrimSpace(string(raw)))
+	}
+
+	run := r.exec
+	if run == nil {
+		run = execCommand
+	}
+
+	result, err := run(ctx, env, r.path(), r.args(node, command, arg...)...)
+
+	if err := classifyError(ctx, result, err); err != nil {
+		return result, &RabbitmqCtlError{
+			Node:    node,
+			Command: command,
+			Result:  result,
+			Err:     err,
+		}
+	}
+
+	return result, nil
+}
+
+func (r *RabbitmqCtl) path() string {
+	if r.Path == "" {
+		return "rabbitmqctl"
+	}
+	return r.Path
+}
+
+// args builds the arguments to pass to rabbitmqctl.
+func (r *RabbitmqCtl) args(node string, command string, arg ...string) []string {
+	var args []string
+
+	if node != "" {
+		args = append(args, "-n", node)
+	}
+
+	if r.Longnames {
+		args = append(args, "--longnames")
+	}
+
+	args = append(args, command)
+	return append(args, arg...)
+}
+
+// classifyError maps the result of running rabbitmqctl to an error.
+func classifyError(ctx context.Context, result *Result, err error) error {
+	if err := ctx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return err
+	}
+
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) || os.IsNotExist(err) {
+			return ErrCommandNotFound
+		}
+		return err
+	}
+
+	switch result.ExitCode {
+	case 0:
+		return nil
+	case exitUsage:
+		return classifyUsage(result.Stderr)
+	case exitTempFail:
+		return ErrTimeout
+	case exitUnavailable, exitLegacyNodeDown:
+		return classifyUnavailable(result.Stderr)
+	default:
+		return fmt.Errorf("exit status %d", result.ExitCode)
+	}
+}
+
+// classifyUnavailable uses the diagnostics that rabbitmqctl prints to determine
+// why a node could not be contacted.
+func classifyUnavailable(stderr string) error {
+	s := strings.ToLower(stderr)
+
+	switch {
+	case strings.Contains(s, "cookie"):
+		return ErrBadCookie
+	case strings.Contains(s, "nxdomain"),
+		strings.Contains(s, "unable to connect to epmd"),
+		strings.Contains(s, "ehostunreach"):
+		return ErrNodeUnreachable
+	default:
+		return ErrNodeDown
+	}
+}
+
+// classifyUsage distinguishes a command that rabbitmqctl doesn't know about
+// from other usage errors, like unsupported arguments or info keys.
+func classifyUsage(stderr string) error {
+	s := strings.ToLower(stderr)
+
+	switch {
+	case strings.Contains(s, "command") && strings.Contains(s, "not found"),
+		strings.Contains(s, "could not recognise command"):
+		return ErrCommandNotFound
+	default:
+		return ErrUsage
+	}
+}
+
+// isConnectionError returns true if the error indicates that rabbitmqctl was
+// unable to communicate with the node.
+func isConnectionError(err error) bool {
+	return errors.Is(err, ErrNodeDown) ||
+		errors.Is(err, ErrNodeUnreachable) ||
+		errors.Is(err, ErrBadCookie) ||
+		errors.Is(err, ErrTimeout)
+}
+
+// execCommand invokes the command using the exec package, with env added to
+// the environment, capturing stdout and stderr.
+func execCommand(ctx context.Context, env []string, name string, arg ...string) (*Result, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, arg...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	result := &Result{
+		Stdout: stdout.String(),
+		Stderr: stderr.String(),
+	}
+
+	if err, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = err.ExitCode()
+		return result, nil
+	}
+
+	return result, err
 }
@@ -0,0 +1,148 @@
+package clusterctl
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRabbitmqCtl_Run(t *testing.T) {
+	cookie, err := ioutil.TempFile("", "erlang.cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cookie.Name())
+	cookie.WriteString("SECRETCOOKIE\n")
+	cookie.Close()
+
+	tests := []struct {
+		ctl  RabbitmqCtl
+		argv []string
+		env  []string
+	}{
+		{
+			RabbitmqCtl{},
+			[]string{"rabbitmqctl", "-n", "rabbit@master", "forget_cluster_node", "rabbit@slave"},
+			nil,
+		},
+		{
+			RabbitmqCtl{Path: "/usr/sbin/rabbitmqctl", Longnames: true},
+			[]string{"/usr/sbin/rabbitmqctl", "-n", "rabbit@master", "--longnames", "forget_cluster_node", "rabbit@slave"},
+			nil,
+		},
+		{
+			RabbitmqCtl{CookieFile: cookie.Name()},
+			// The cookie must not be visible in the process list.
+			[]string{"rabbitmqctl", "-n", "rabbit@master", "forget_cluster_node", "rabbit@slave"},
+			[]string{"RABBITMQ_ERLANG_COOKIE=SECRETCOOKIE"},
+		},
+	}
+
+	for _, tt := range tests {
+		r := new(argvRecorder)
+		ctl := tt.ctl
+		ctl.exec = r.exec
+
+		_, err := ctl.Run("rabbit@master", "forget_cluster_node", "rabbit@slave")
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{tt.argv}, r.argv)
+		assert.Equal(t, tt.env, r.env)
+	}
+}
+
+func TestRabbitmqCtl_Run_MissingCookieFile(t *testing.T) {
+	r := new(argvRecorder)
+	ctl := &RabbitmqCtl{CookieFile: "/does/not/exist", exec: r.exec}
+
+	_, err := ctl.Run("rabbit@master", "status")
+	assert.Error(t, err)
+	assert.Nil(t, r.argv)
+}
+
+func TestRabbitmqCtl_Exec_Errors(t *testing.T) {
+	tests := []struct {
+		result *Result
+		err    error
+	}{
+		{&Result{Stdout: "ok"}, nil},
+		{&Result{ExitCode: 64, Stderr: "Command `foo' not found."}, ErrCommandNotFound},
+		{&Result{ExitCode: 64, Stderr: "Error: could not recognise command"}, ErrCommandNotFound},
+		{&Result{ExitCode: 64, Stderr: "Error: Info key(s) type,members are not supported"}, ErrUsage},
+		{&Result{ExitCode: 69, Stderr: "Error: unable to perform an operation on node 'rabbit@master'.\n * node rabbit@master down"}, ErrNodeDown},
+		{&Result{ExitCode: 2, Stderr: "Error: unable to connect to node rabbit@master: nodedown"}, ErrNodeDown},
+		{&Result{ExitCode: 69, Stderr: " * unable to connect to epmd (port 4369) on master: nxdomain (non-existing domain)"}, ErrNodeUnreachable},
+		{&Result{ExitCode: 69, Stderr: "Authentication failed (rejected by the remote node), please check the Erlang cookie"}, ErrBadCookie},
+		{&Result{ExitCode: 75, Stderr: "Error: operation join_cluster on node rabbit@slave timed out."}, ErrTimeout},
+	}
+
+	for _, tt := range tests {
+		result := tt.result
+		ctl := &RabbitmqCtl{
+			exec: func(ctx context.Context, env []string, name string, arg ...string) (*Result, error) {
+				return result, nil
+			},
+		}
+
+		res, err := ctl.Exec(context.Background(), "rabbit@master", "join_cluster")
+		assert.Equal(t, tt.result, res)
+
+		if tt.err == nil {
+			assert.NoError(t, err)
+			continue
+		}
+
+		if assert.IsType(t, &RabbitmqCtlError{}, err) {
+			e := err.(*RabbitmqCtlError)
+			assert.Equal(t, "rabbit@master", e.Node)
+			assert.Equal(t, "join_cluster", e.Command)
+			assert.Equal(t, tt.err, e.Err)
+		}
+	}
+}
+
+func TestRabbitmqCtl_Run_Timeout(t *testing.T) {
+	ctl := &RabbitmqCtl{
+		Timeout: time.Millisecond,
+		exec: func(ctx context.Context, env []string, name string, arg ...string) (*Result, error) {
+			<-ctx.Done()
+			return &Result{ExitCode: -1}, nil
+		},
+	}
+
+	_, err := ctl.Run("rabbit@slave", "join_cluster", "rabbit@master")
+	assert.True(t, errors.Is(err, ErrTimeout))
+}
+
+func TestExecCommand(t *testing.T) {
+	result, err := execCommand(context.Background(), []string{"OUT=out"}, "sh", "-c", "echo $OUT; echo err >&2; exit 69")
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{Stdout: "out\n", Stderr: "err\n", ExitCode: 69}, result)
+}
+
+// argvRecorder records the argv of every command that it's asked to execute,
+// and the environment added for the last one.
+type argvRecorder struct {
+	argv [][]string
+	env  []string
+
+	// The stdout to return for a given rabbitmqctl command.
+	stdout map[string]string
+}
+
+func (r *argvRecorder) exec(ctx context.Context, env []string, name string, arg ...string) (*Result, error) {
+	r.argv = append(r.argv, append([]string{name}, arg...))
+	r.env = env
+
+	for _, a := range arg {
+		if out, ok := r.stdout[a]; ok {
+			return &Result{Stdout: out}, nil
+		}
+	}
+
+	return &Result{}, nil
+}
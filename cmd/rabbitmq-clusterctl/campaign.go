@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
+
+var cmdCampaign = cli.Command{
+	Name:   "campaign",
+	Usage:  "Waits until this node is elected master in etcd, then holds the master lease until interrupted. Requires an etcd:// --master.",
+	Action: runCampaign,
+}
+
+var errLostLease = errors.New("lost the master lease")
+
+func runCampaign(c *cli.Context) {
+	if c.GlobalBool("dry-run") {
+		must(errors.New("campaign does not support --dry-run"))
+	}
+
+	ctl := newController(c)
+
+	m := etcdMasterController(ctl.MasterController)
+	if m == nil {
+		must(errors.New("campaign requires an etcd:// --master"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	start := time.Now()
+	lost, err := m.Campaign(ctx, ctl.Node)
+	must(err)
+
+	printResult(c, &clusterctl.OperationResult{
+		Operation: clusterctl.OperationCampaign,
+		Node:      ctl.Node,
+		Action:    clusterctl.ActionElected,
+		Duration:  time.Since(start),
+		Master:    ctl.Node,
+	}, fmt.Sprintf("%s elected master", ctl.Node))
+
+	<-lost
+	if ctx.Err() == nil {
+		must(errLostLease)
+	}
+}
+
+// etcdMasterController returns the EtcdMasterController that the master is
+// stored in, unwrapping any middleware, or nil if it isn't stored in etcd.
+func etcdMasterController(m clusterctl.MasterController) *clusterctl.EtcdMasterController {
+	for {
+		if e, ok := m.(*clusterctl.EtcdMasterController); ok {
+			return e
+		}
+
+		u, ok := m.(interface {
+			Unwrap() clusterctl.MasterController
+		})
+		if !ok {
+			return nil
+		}
+		m = u.Unwrap()
+	}
+}
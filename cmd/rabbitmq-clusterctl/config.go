@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is the config file that's loaded when --config isn't given.
+// It's fine for it not to exist.
+const DefaultConfigFile = "/etc/rabbitmq-clusterctl.yml"
+
+var cmdConfig = cli.Command{
+	Name:   "config",
+	Usage:  "config show: Prints the effective configuration, and where each value came from.",
+	Action: runConfig,
+}
+
+func runConfig(c *cli.Context) {
+	if c.Args().First() != "show" {
+		must(fmt.Errorf("unknown config command %q, must be \"show\"", c.Args().First()))
+	}
+
+	cfg := mustConfig(c)
+
+	values := make([]configValue, len(cfg.options))
+	for i, o := range cfg.options {
+		values[i] = configValue{Key: o.Key, Value: o.Value, Source: o.Source}
+	}
+
+	printOutput(c, values, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, v := range values {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", v.Key, v.Value, v.Source)
+		}
+		w.Flush()
+	})
+}
+
+// configValue is an effective configuration value, as printed by `config show`.
+type configValue struct {
+	Key    string `json:"key" yaml:"key"`
+	Value  string `json:"value" yaml:"value"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// option is a single configuration value. Values are resolved in order of
+// precedence: flags, then environment variables, then the config file, then
+// the default.
+type option struct {
+	// The key in the config file. Nested keys are separated with ".".
+	Key string
+
+	// The global flag and environment variable that set the option, if
+	// any.
+	Flag   string
+	EnvVar string
+
+	// The default value.
+	Default string
+
+	// The type of the value ("string", "bool" or "duration"), used to
+	// validate it.
+	Type string
+
+	// The allowed values, if the option is one of a fixed set of values.
+	Values []string
+
+	// The effective value, and where it came from.
+	Value  string
+	Source string
+}
+
+// options returns all of the configuration options, with their defaults.
+func options() []*option {
+	return []*option{
+		{Key: "master", Flag: "master", EnvVar: "RABBITMQ_CLUSTERCTL_MASTER"},
+		{Key: "node", Flag: "node", EnvVar: "RABBITMQ_NODENAME", Default: clusterctl.DefaultNodeTemplate},
+		{Key: "rabbitmqctl", Flag: "rabbitmqctl", EnvVar: "RABBITMQCTL", Default: "rabbitmqctl"},
+		{Key: "longnames", Flag: "longnames", EnvVar: "RABBITMQ_USE_LONGNAME", Default: "false", Type: "bool"},
+		{Key: "erlang_cookie_file", Flag: "erlang-cookie-file", EnvVar: "RABBITMQ_ERLANG_COOKIE_FILE"},
+		{Key: "output", Flag: "output", EnvVar: "RABBITMQ_CLUSTERCTL_OUTPUT", Default: OutputText, Values: []string{OutputText, OutputJSON, OutputYAML}},
+		{Key: "timeout", Flag: "timeout", EnvVar: "RABBITMQCTL_TIMEOUT", Default: clusterctl.DefaultTimeout.String(), Type: "duration"},
+		{Key: "aws.region", EnvVar: "AWS_REGION"},
+		{Key: "aws.profile", EnvVar: "AWS_PROFILE"},
+		{Key: "policy.allow_force_remove", EnvVar: "RABBITMQ_CLUSTERCTL_ALLOW_FORCE_REMOVE", Default: "true", Type: "bool"},
+	}
+}
+
+// config is the effective configuration of the CLI, merged from defaults, the
+// config file, environment variables and flags.
+type config struct {
+	options []*option
+}
+
+// loadConfig loads the configuration. The config file is given by --config; if
+// it isn't given, DefaultConfigFile is loaded if it exists.
+func loadConfig(c *cli.Context) (*config, error) {
+	cfg := &config{options: options()}
+
+	for _, o := range cfg.options {
+		o.Value, o.Source = o.Default, "default"
+	}
+
+	path, explicit := c.GlobalString("config"), true
+	if path == "" {
+		path, explicit = DefaultConfigFile, false
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) || explicit {
+			return nil, err
+		}
+	}
+
+	for key := range values {
+		if cfg.option(key) == nil {
+			return nil, fmt.Errorf("%s: unknown config key %q", path, key)
+		}
+	}
+
+	for _, o := range cfg.options {
+		if v, ok := values[o.Key]; ok {
+			o.Value, o.Source = v, fmt.Sprintf("config file (%s)", path)
+		}
+
+		if v := os.Getenv(o.EnvVar); o.EnvVar != "" && v != "" {
+			o.Value, o.Source = v, fmt.Sprintf("env ($%s)", o.EnvVar)
+		}
+
+		if o.Flag != "" {
+			if v, ok := flagValue(c, o); ok {
+				o.Value, o.Source = v, fmt.Sprintf("flag (--%s)", o.Flag)
+			}
+		}
+
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("%s (from %s): %v", o.Key, o.Source, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// mustConfig loads the configuration, exiting if it's invalid.
+func mustConfig(c *cli.Context) *config {
+	cfg, err := loadConfig(c)
+	must(err)
+	errorFormat = cfg.String("output")
+	return cfg
+}
+
+// setFlags records which global flags were given on the command line. The cli
+// package can only tell whether a flag was set from the context that it was
+// parsed in, so setFlags is recorded by recordSetFlags in the app's Before
+// hook, where the context's flags are the global flags.
+var setFlags map[string]bool
+
+// recordSetFlags records which of the global flags for options were given on
+// the command line.
+func recordSetFlags(c *cli.Context) error {
+	setFlags = make(map[string]bool)
+	for _, o := range options() {
+		if o.Flag != "" && c.IsSet(o.Flag) {
+			setFlags[o.Flag] = true
+		}
+	}
+	return nil
+}
+
+// flagValue returns the value of the global flag for the option, and whether
+// it was given on the command line.
+func flagValue(c *cli.Context, o *option) (string, bool) {
+	if !setFlags[o.Flag] {
+		return "", false
+	}
+
+	switch o.Type {
+	case "bool":
+		return strconv.FormatBool(c.GlobalBool(o.Flag)), true
+	case "duration":
+		return c.GlobalDuration(o.Flag).String(), true
+	default:
+		return c.GlobalString(o.Flag), true
+	}
+}
+
+// readConfigFile reads a YAML config file, returning the values keyed by their
+// flattened keys (e.g. aws.region).
+func readConfigFile(path string) (map[string]string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", doc, values)
+	return values, nil
+}
+
+// flatten flattens nested maps into values, joining keys with ".".
+func flatten(prefix string, v interface{}, values map[string]string) {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		for k, vv := range m {
+			key := fmt.Sprint(k)
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flatten(key, vv, values)
+		}
+		return
+	}
+
+	if prefix == "" {
+		return
+	}
+
+	if v == nil {
+		values[prefix] = ""
+	} else {
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+func (o *option) validate() error {
+	if o.Value == "" {
+		return nil
+	}
+
+	if len(o.Values) > 0 && !contains(o.Values, o.Value) {
+		return fmt.Errorf("invalid value %q, must be one of %s", o.Value, strings.Join(o.Values, ", "))
+	}
+
+	switch o.Type {
+	case "bool":
+		_, err := strconv.ParseBool(o.Value)
+		return err
+	case "duration":
+		_, err := time.ParseDuration(o.Value)
+		return err
+	}
+
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, vv := range values {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// option returns the option with the given key, or nil.
+func (cfg *config) option(key string) *option {
+	for _, o := range cfg.options {
+		if o.Key == key {
+			return o
+		}
+	}
+	return nil
+}
+
+// String returns the value of an option.
+func (cfg *config) String(key string) string {
+	return cfg.option(key).Value
+}
+
+// Bool returns the value of a bool option.
+func (cfg *config) Bool(key string) bool {
+	v, _ := strconv.ParseBool(cfg.String(key))
+	return v
+}
+
+// Duration returns the value of a duration option.
+func (cfg *config) Duration(key string) time.Duration {
+	d, _ := time.ParseDuration(cfg.String(key))
+	return d
+}
+
+// Node returns the name of the node that's being operated on, expanding the
+// node template. When no template is configured and longnames is enabled, the
+// FQDN of the host is used.
+func (cfg *config) Node() (string, error) {
+	tmpl := cfg.String("node")
+	if cfg.option("node").Source == "default" && cfg.Bool("longnames") {
+		tmpl = "{{.Prefix}}@{{.FQDN}}"
+	}
+
+	node, err := clusterctl.ExpandNodeTemplate(tmpl, clusterctl.NewNodeTemplateData())
+	if err != nil {
+		return "", err
+	}
+
+	return node.String(), nil
+}
+
+// applyAWS exports the AWS region and profile to the environment, so that
+// they're picked up by the AWS SDK.
+func (cfg *config) applyAWS() {
+	for key, env := range map[string]string{
+		"aws.region":  "AWS_REGION",
+		"aws.profile": "AWS_PROFILE",
+	} {
+		if v := cfg.String(key); v != "" && os.Getenv(env) == "" {
+			os.Setenv(env, v)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "rabbitmq-clusterctl.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	file := "config file (" + f.Name() + ")"
+
+	type value struct {
+		Value, Source string
+	}
+
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+
+		// The expected values of the master, longnames and timeout
+		// options.
+		master, longnames, timeout value
+	}{
+		{
+			name:      "default",
+			master:    value{"", "default"},
+			longnames: value{"false", "default"},
+			timeout:   value{"5m0s", "default"},
+		},
+		{
+			name:      "file",
+			file:      "master: static://rabbit@a\nlongnames: true\ntimeout: 1m\n",
+			master:    value{"static://rabbit@a", file},
+			longnames: value{"true", file},
+			timeout:   value{"1m", file},
+		},
+		{
+			name: "env",
+			file: "master: static://rabbit@a\nlongnames: false\ntimeout: 1m\n",
+			env: map[string]string{
+				"RABBITMQ_CLUSTERCTL_MASTER": "static://rabbit@b",
+				"RABBITMQ_USE_LONGNAME":      "true",
+				"RABBITMQCTL_TIMEOUT":        "2m",
+			},
+			master:    value{"static://rabbit@b", "env ($RABBITMQ_CLUSTERCTL_MASTER)"},
+			longnames: value{"true", "env ($RABBITMQ_USE_LONGNAME)"},
+			timeout:   value{"2m", "env ($RABBITMQCTL_TIMEOUT)"},
+		},
+		{
+			name: "flag",
+			file: "master: static://rabbit@a\ntimeout: 1m\n",
+			env: map[string]string{
+				"RABBITMQ_CLUSTERCTL_MASTER": "static://rabbit@b",
+				"RABBITMQCTL_TIMEOUT":        "2m",
+			},
+			args:      []string{"--master", "static://rabbit@c", "--longnames", "--timeout", "3m"},
+			master:    value{"static://rabbit@c", "flag (--master)"},
+			longnames: value{"true", "flag (--longnames)"},
+			timeout:   value{"3m0s", "flag (--timeout)"},
+		},
+		{
+			// Flags that are given with the same value as the
+			// environment still come from the flag.
+			name: "flag matching env",
+			env: map[string]string{
+				"RABBITMQ_CLUSTERCTL_MASTER": "static://rabbit@b",
+				"RABBITMQ_USE_LONGNAME":      "true",
+				"RABBITMQCTL_TIMEOUT":        "3m",
+			},
+			args:      []string{"--master", "static://rabbit@b", "--longnames=false", "--timeout", "3m"},
+			master:    value{"static://rabbit@b", "flag (--master)"},
+			longnames: value{"false", "flag (--longnames)"},
+			timeout:   value{"3m0s", "flag (--timeout)"},
+		},
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(f.Name(), []byte(tt.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, o := range options() {
+			if o.EnvVar != "" {
+				os.Unsetenv(o.EnvVar)
+			}
+		}
+		for k, v := range tt.env {
+			os.Setenv(k, v)
+		}
+
+		cfg, err := testConfig(append([]string{"--config", f.Name()}, tt.args...))
+		if !assert.NoError(t, err, tt.name) {
+			continue
+		}
+
+		for key, want := range map[string]value{
+			"master":    tt.master,
+			"longnames": tt.longnames,
+			"timeout":   tt.timeout,
+		} {
+			o := cfg.option(key)
+			assert.Equal(t, want, value{o.Value, o.Source}, "%s: %s", tt.name, key)
+		}
+	}
+
+	for _, o := range options() {
+		if o.EnvVar != "" {
+			os.Unsetenv(o.EnvVar)
+		}
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	_, err := testConfig([]string{"--config", "/does/not/exist"})
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "rabbitmq-clusterctl.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("timeout: soon\n")
+	f.Close()
+
+	_, err = testConfig([]string{"--config", f.Name()})
+	assert.EqualError(t, err, `timeout (from config file (`+f.Name()+`)): time: invalid duration "soon"`)
+}
+
+// testConfig runs the app with the given global flags, returning the loaded
+// configuration.
+func testConfig(args []string) (*config, error) {
+	var (
+		cfg *config
+		err error
+	)
+
+	app := newApp()
+	app.Action = func(c *cli.Context) {
+		cfg, err = loadConfig(c)
+	}
+
+	if err := app.Run(append([]string{"rabbitmq-clusterctl"}, args...)); err != nil {
+		return nil, err
+	}
+
+	return cfg, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
+
+var cmdFailover = cli.Command{
+	Name:   "failover",
+	Usage:  "Hands over the master role to another node. Can be run from any member of the cluster.",
+	Action: runFailover,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "The node to hand over to. The default is the best candidate: a running, fully synchronised node without alarms.",
+		},
+		cli.DurationFlag{
+			Name:  "reconnect-timeout",
+			Value: clusterctl.DefaultReconnectTimeout,
+			Usage: "Maximum amount of time to wait for clients to reconnect to the new master.",
+		},
+	},
+}
+
+func runFailover(c *cli.Context) {
+	ctl := newController(c)
+	r, err := ctl.Failover(clusterctl.FailoverOptions{
+		To:               c.String("to"),
+		ReconnectTimeout: c.Duration("reconnect-timeout"),
+	})
+
+	// The master was changed even if clients didn't reconnect, so the
+	// result is printed before the error.
+	if r != nil {
+		switch r.Action {
+		case clusterctl.ActionNone:
+			printResult(c, r, fmt.Sprintf("%s is already the master", r.Master))
+		default:
+			printResult(c, r, fmt.Sprintf("failed over from %s to %s", r.PreviousMaster, r.Master))
+		}
+	}
+	must(err)
+}
@@ -1,14 +1,42 @@
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
 
 var cmdJoin = cli.Command{
 	Name:   "join",
 	Usage:  "Joins this node to the cluster",
 	Action: runJoin,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "ram",
+			Usage: "Join the cluster as a ram node.",
+		},
+		cli.BoolFlag{
+			Name:  "reset-on-failure",
+			Usage: "Reset the node before restarting the app if joining the cluster fails.",
+		},
+	},
 }
 
 func runJoin(c *cli.Context) {
+	nodeType := clusterctl.NodeTypeDisc
+	if c.Bool("ram") {
+		nodeType = clusterctl.NodeTypeRAM
+	}
+
 	ctl := newController(c)
-	must(ctl.Join())
+	r, err := ctl.Join(nodeType, c.Bool("reset-on-failure"))
+	must(err)
+
+	switch clusterctl.JoinAction(r.Action) {
+	case clusterctl.JoinActionAlreadyMember:
+		printResult(c, r, fmt.Sprintf("%s is already a member of the cluster", r.Node))
+	default:
+		printResult(c, r, fmt.Sprintf("%s joined the cluster", r.Node))
+	}
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/codegangsta/cli"
@@ -11,31 +10,138 @@ import (
 var commands = []cli.Command{
 	cmdMaster,
 	cmdPromote,
+	cmdFailover,
+	cmdWatch,
 	cmdJoin,
 	cmdRemove,
+	cmdSetType,
+	cmdCampaign,
+	cmdStatus,
+	cmdConfig,
+}
+
+var flags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		Usage:  "Path to the config file (default " + DefaultConfigFile + ").",
+		EnvVar: "RABBITMQ_CLUSTERCTL_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "master",
+		Usage:  "URL of the master backend (e.g. elb://rabbitmq?sync_queues=true). See the README for the available backends.",
+		EnvVar: "RABBITMQ_CLUSTERCTL_MASTER",
+	},
+	cli.StringFlag{
+		Name:   "node",
+		Usage:  "Name of the node to operate on, or a template for it (default " + clusterctl.DefaultNodeTemplate + "). See the README for the template values.",
+		EnvVar: "RABBITMQ_NODENAME",
+	},
+	cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Print the rabbitmqctl commands and AWS API calls that would change the cluster or the master, in order, without running them.",
+	},
+	cli.StringFlag{
+		Name:   "output",
+		Usage:  "Output format of results: text, json or yaml (default text).",
+		EnvVar: "RABBITMQ_CLUSTERCTL_OUTPUT",
+	},
+	cli.StringFlag{
+		Name:   "rabbitmqctl",
+		Usage:  "Path to the rabbitmqctl binary (default rabbitmqctl).",
+		EnvVar: "RABBITMQCTL",
+	},
+	cli.BoolFlag{
+		Name:   "longnames",
+		Usage:  "Pass --longnames to rabbitmqctl, for nodes that use fully qualified hostnames.",
+		EnvVar: "RABBITMQ_USE_LONGNAME",
+	},
+	cli.StringFlag{
+		Name:   "erlang-cookie-file",
+		Usage:  "Path to a file containing the erlang cookie to use when connecting to nodes.",
+		EnvVar: "RABBITMQ_ERLANG_COOKIE_FILE",
+	},
+	cli.DurationFlag{
+		Name:   "timeout",
+		Usage:  "Maximum amount of time that a single rabbitmqctl invocation can take (default " + clusterctl.DefaultTimeout.String() + ").",
+		EnvVar: "RABBITMQCTL_TIMEOUT",
+	},
 }
 
 func main() {
+	newApp().Run(os.Args)
+}
+
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "rabbitmq-clusterctl"
 	app.Usage = "Perform rabbitmq node operations"
 	app.Commands = commands
-	app.Run(os.Args)
+	app.Flags = flags
+	app.Before = func(c *cli.Context) error {
+		recordErrorFormat(c)
+		return recordSetFlags(c)
+	}
+	return app
 }
 
 func newController(c *cli.Context) *clusterctl.Controller {
-	hostname, _ := os.Hostname()
+	cfg := mustConfig(c)
+	cfg.applyAWS()
+
+	node, err := cfg.Node()
+	must(err)
+
+	ctl := newRabbitmqCtl(cfg)
+	controller := &clusterctl.Controller{
+		Node:                 node,
+		MasterController:     newMasterController(cfg, ctl),
+		MembershipController: clusterctl.NewRabbitmqCtlMembershipController(ctl),
+	}
+
+	if c.GlobalBool("dry-run") {
+		must(controller.DryRun(new(clusterctl.Plan)))
+	}
+
+	return controller
+}
+
+// newMasterController returns the MasterController for the master URL given by
+// --master. Without it, the classic ELB named by $ELB_NAME is the master. The
+// master is wrapped with a DynamoDB promotion lock when DYNAMODB_LOCK_TABLE is
+// set, unless the URL configures the lock itself.
+func newMasterController(cfg *config, ctl *clusterctl.RabbitmqCtl) clusterctl.MasterController {
+	url := cfg.String("master")
+	if url == "" {
+		url = "elb://" + os.Getenv("ELB_NAME")
+	}
+
+	u, err := clusterctl.ParseMasterURL(url)
+	must(err)
+
+	m, err := clusterctl.NewMasterController(url, &clusterctl.MasterOptions{RabbitmqCtl: ctl})
+	must(err)
+
+	if table := os.Getenv("DYNAMODB_LOCK_TABLE"); table != "" {
+		if _, ok := u.Query["dynamodb_lock"]; !ok {
+			m = clusterctl.DynamoDBLock(m, table)
+		}
+	}
+
+	return m
+}
 
-	return &clusterctl.Controller{
-		Node:                 fmt.Sprintf("rabbit@%s", hostname),
-		MasterController:     clusterctl.NewELBMasterController(os.Getenv("ELB_NAME")),
-		MembershipController: clusterctl.DefaultMembershipController,
+func newRabbitmqCtl(cfg *config) *clusterctl.RabbitmqCtl {
+	return &clusterctl.RabbitmqCtl{
+		Path:       cfg.String("rabbitmqctl"),
+		Longnames:  cfg.Bool("longnames"),
+		CookieFile: cfg.String("erlang_cookie_file"),
+		Timeout:    cfg.Duration("timeout"),
 	}
 }
 
 func must(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		printError(os.Stderr, errorFormat, err)
 		os.Exit(1)
 	}
 }
@@ -1,10 +1,6 @@
 package main
 
-import (
-	"fmt"
-
-	"github.com/codegangsta/cli"
-)
+import "github.com/codegangsta/cli"
 
 var cmdMaster = cli.Command{
 	Name:   "master",
@@ -14,7 +10,7 @@ var cmdMaster = cli.Command{
 
 func runMaster(c *cli.Context) {
 	ctl := newController(c)
-	node, err := ctl.Master()
+	r, err := ctl.CurrentMaster()
 	must(err)
-	fmt.Println(node)
+	printResult(c, r, r.Master)
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats that can be given to --output.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+// errorFormat is the format that must prints errors in. It's set from
+// --output in the app's Before hook, and from the effective configuration once
+// it has been loaded, so that errors loading the configuration are still
+// printed in the format given on the command line.
+var errorFormat = OutputText
+
+// recordErrorFormat records the output format given by --output or
+// $RABBITMQ_CLUSTERCTL_OUTPUT, before the configuration is loaded.
+func recordErrorFormat(c *cli.Context) {
+	if format := c.String("output"); format != "" {
+		errorFormat = format
+	}
+}
+
+// printOutput prints the result of a command in the format given by --output.
+// text is called to print the result when the format is text.
+func printOutput(c *cli.Context, v interface{}, text func()) {
+	format := mustConfig(c).String("output")
+	if format != OutputJSON && format != OutputYAML {
+		text()
+		return
+	}
+
+	must(encode(os.Stdout, format, v))
+}
+
+// printError prints an error to w, in the given format. In the json and yaml
+// formats, the error is printed as {"error": "..."}.
+func printError(w io.Writer, format string, err error) {
+	switch format {
+	case OutputJSON, OutputYAML:
+		if encode(w, format, map[string]string{"error": err.Error()}) == nil {
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "error: %v\n", err)
+}
+
+// encode writes v to w in the json or yaml format.
+func encode(w io.Writer, format string, v interface{}) error {
+	if format == OutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	raw, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// printResult prints the result of a Controller operation. In dry run mode, the
+// plan is printed as text, since the operation wasn't actually performed.
+func printResult(c *cli.Context, r *clusterctl.OperationResult, text string) {
+	printOutput(c, r, func() {
+		if !r.DryRun {
+			fmt.Println(text)
+			return
+		}
+
+		if len(r.Plan) == 0 {
+			fmt.Println("dry run: no changes would be made")
+			return
+		}
+
+		fmt.Println("dry run: the following changes would be made:")
+		for i, step := range r.Plan {
+			fmt.Printf("  %d. %s\n", i+1, step)
+		}
+	})
+}
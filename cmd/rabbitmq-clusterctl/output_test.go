@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintError(t *testing.T) {
+	tests := []struct {
+		format string
+		out    string
+	}{
+		{OutputText, "error: node rabbit@a is down\n"},
+		{"", "error: node rabbit@a is down\n"},
+		{OutputJSON, "{\n  \"error\": \"node rabbit@a is down\"\n}\n"},
+		{OutputYAML, "error: node rabbit@a is down\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		printError(&buf, tt.format, errors.New("node rabbit@a is down"))
+		assert.Equal(t, tt.out, buf.String(), tt.format)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
 
 var cmdPromote = cli.Command{
 	Name:   "promote",
@@ -10,5 +14,12 @@ var cmdPromote = cli.Command{
 
 func runPromote(c *cli.Context) {
 	ctl := newController(c)
-	must(ctl.Promote())
+	r, err := ctl.Promote()
+	must(err)
+
+	text := fmt.Sprintf("%s promoted to master", r.Node)
+	if r.PreviousMaster != "" {
+		text = fmt.Sprintf("%s, replacing %s", text, r.PreviousMaster)
+	}
+	printResult(c, r, text)
 }
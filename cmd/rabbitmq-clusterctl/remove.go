@@ -1,14 +1,33 @@
 package main
 
-import "github.com/codegangsta/cli"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
 
 var cmdRemove = cli.Command{
 	Name:   "remove",
 	Usage:  "Removes this node from the cluster.",
 	Action: runRemove,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Remove the node even if it could result in data loss.",
+		},
+	},
 }
 
+var errForceRemoveDisabled = errors.New("--force is disabled by the policy.allow_force_remove config option")
+
 func runRemove(c *cli.Context) {
+	if c.Bool("force") && !mustConfig(c).Bool("policy.allow_force_remove") {
+		must(errForceRemoveDisabled)
+	}
+
 	ctl := newController(c)
-	must(ctl.Remove())
+	r, err := ctl.Remove(c.Bool("force"))
+	must(err)
+	printResult(c, r, fmt.Sprintf("%s removed from the cluster", r.Node))
 }
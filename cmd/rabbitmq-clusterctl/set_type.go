@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
+
+var cmdSetType = cli.Command{
+	Name:   "set-type",
+	Usage:  "Changes this node to a disc or ram node. Usage: set-type disc|ram",
+	Action: runSetType,
+}
+
+func runSetType(c *cli.Context) {
+	nodeType, err := clusterctl.ParseNodeType(c.Args().First())
+	must(err)
+
+	ctl := newController(c)
+	r, err := ctl.SetType(nodeType)
+	must(err)
+
+	text := fmt.Sprintf("%s changed to a %s node", r.Node, nodeType)
+	if r.Action == clusterctl.ActionNone {
+		text = fmt.Sprintf("%s is already a %s node", r.Node, nodeType)
+	}
+	printResult(c, r, text)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
+
+var cmdStatus = cli.Command{
+	Name:   "status",
+	Usage:  "Shows the state of the cluster and the master. Exits non-zero if any problems are detected.",
+	Action: runStatus,
+}
+
+func runStatus(c *cli.Context) {
+	s, err := newController(c).Status()
+	must(err)
+
+	printOutput(c, s, func() {
+		printStatus(s)
+	})
+
+	if !s.Healthy() {
+		os.Exit(1)
+	}
+}
+
+func printStatus(s *clusterctl.Status) {
+	fmt.Printf("node:   %s\n", s.Node)
+
+	switch {
+	case s.MasterError != nil:
+		fmt.Printf("master: unknown (%v)\n", s.MasterError)
+	case s.MasterHealth != nil:
+		fmt.Printf("master: %s (%s)\n", s.Master, s.MasterHealth.State)
+	default:
+		fmt.Printf("master: %s\n", s.Master)
+	}
+
+	fmt.Println("nodes:")
+	for _, node := range s.Cluster.Nodes() {
+		nodeType, state := "ram", "stopped"
+		if s.Cluster.IsDisc(node) {
+			nodeType = "disc"
+		}
+		if s.Cluster.IsRunning(node) {
+			state = "running"
+		}
+		fmt.Printf("  %s %s %s\n", node, nodeType, state)
+	}
+
+	var partitioned []string
+	for node := range s.Cluster.Partitions {
+		partitioned = append(partitioned, node)
+	}
+	sort.Strings(partitioned)
+	for _, node := range partitioned {
+		fmt.Printf("partition: %s can't reach %s\n", node, strings.Join(s.Cluster.Partitions[node], ", "))
+	}
+
+	for _, alarm := range s.Cluster.Alarms {
+		fmt.Printf("alarm: %s on %s\n", alarm.Resource, alarm.Node)
+	}
+
+	for _, q := range s.UnsynchronisedQueues {
+		fmt.Printf("unsynchronised: vhost=%s queue=%s node=%s unsynchronised=%s\n", q.VHost, q.Name, q.Node, strings.Join(q.Unsynchronised, ","))
+	}
+
+	if s.Healthy() {
+		fmt.Println("status: ok")
+		return
+	}
+
+	fmt.Println("problems:")
+	for _, p := range s.Problems {
+		fmt.Printf("  %s\n", p)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/codegangsta/cli"
+	"github.com/remind101/rabbitmq-clusterctl"
+)
+
+// DefaultPauseFile is the file that pauses `watch` while it exists.
+const DefaultPauseFile = "/var/run/rabbitmq-clusterctl.pause"
+
+var cmdWatch = cli.Command{
+	Name:   "watch",
+	Usage:  "Watches the master, and fails over to a synchronised replacement when it fails. `watch pause` and `watch resume` pause and resume running watchers.",
+	Action: runWatch,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "interval",
+			Value: clusterctl.DefaultWatchInterval,
+			Usage: "Amount of time between checks of the master.",
+		},
+		cli.IntFlag{
+			Name:  "failure-threshold",
+			Value: clusterctl.DefaultFailureThreshold,
+			Usage: "Number of failed checks before the master is replaced.",
+		},
+		cli.IntFlag{
+			Name:  "recovery-threshold",
+			Value: clusterctl.DefaultRecoveryThreshold,
+			Usage: "Number of consecutive successful checks before failed checks are forgotten.",
+		},
+		cli.DurationFlag{
+			Name:  "cooldown",
+			Value: clusterctl.DefaultFailoverCooldown,
+			Usage: "Minimum amount of time between failovers.",
+		},
+		cli.StringFlag{
+			Name:   "pause-file",
+			Value:  DefaultPauseFile,
+			Usage:  "While this file exists, the master isn't checked or replaced.",
+			EnvVar: "RABBITMQ_CLUSTERCTL_PAUSE_FILE",
+		},
+		cli.DurationFlag{
+			Name:  "reconnect-timeout",
+			Value: clusterctl.DefaultReconnectTimeout,
+			Usage: "Maximum amount of time to wait for clients to reconnect to the new master.",
+		},
+	},
+}
+
+func runWatch(c *cli.Context) {
+	pauseFile := c.String("pause-file")
+
+	switch c.Args().First() {
+	case "pause":
+		must(ioutil.WriteFile(pauseFile, nil, 0644))
+		fmt.Printf("watchers paused until %s is removed\n", pauseFile)
+		return
+	case "resume":
+		if err := os.Remove(pauseFile); err != nil && !os.IsNotExist(err) {
+			must(err)
+		}
+		fmt.Println("watchers resumed")
+		return
+	case "":
+	default:
+		must(fmt.Errorf("unknown watch command %q, must be \"pause\" or \"resume\"", c.Args().First()))
+	}
+
+	w := clusterctl.NewWatcher(newController(c), clusterctl.WatchOptions{
+		Interval:          c.Duration("interval"),
+		FailureThreshold:  c.Int("failure-threshold"),
+		RecoveryThreshold: c.Int("recovery-threshold"),
+		Cooldown:          c.Duration("cooldown"),
+		PauseFile:         pauseFile,
+		Failover: clusterctl.FailoverOptions{
+			ReconnectTimeout: c.Duration("reconnect-timeout"),
+		},
+	})
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	w.Logf = logger.Printf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	logger.Printf("watching the master from %s", w.Node)
+	w.Run(ctx, func(r *clusterctl.OperationResult, err error) {
+		if r != nil {
+			printResult(c, r, fmt.Sprintf("failed over from %s to %s", r.PreviousMaster, r.Master))
+		}
+		if err != nil {
+			logger.Printf("error: %v", err)
+		}
+	})
+}
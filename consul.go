@@ -0,0 +1,255 @@
+package clusterctl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultConsulAddress is the default address of the Consul agent.
+const DefaultConsulAddress = "http://127.0.0.1:8500"
+
+var (
+	errNoMaster       = errors.New("no master has been set")
+	errMasterLocked   = errors.New("master is being changed by another process")
+	errMasterConflict = errors.New("master was changed by another process")
+)
+
+func init() {
+	// consul://<agent address>/<key>?token=<acl token>
+	RegisterMaster("consul", func(u *MasterURL) (MasterController, error) {
+		m := NewConsulMasterController(u.Host(), u.Path())
+		m.Token = u.Get("token")
+		return m, nil
+	})
+}
+
+// MasterMismatchError is returned by CompareAndSetMaster when the current master
+// is not the expected master.
+type MasterMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+// Error implements the error interface.
+func (e *MasterMismatchError) Error() string {
+	return fmt.Sprintf("expected master to be %s, but it is %s", e.Expected, e.Actual)
+}
+
+// ConsulMasterController implements the MasterController interface using a
+// key in Consul's KV store as the source of truth. Changes to the master are
+// serialized with a Consul session lock, so concurrent promotions can't both
+// win.
+type ConsulMasterController struct {
+	// The address of the Consul agent (e.g. http://127.0.0.1:8500).
+	Address string
+
+	// The KV key that stores the node name of the master. The lock is
+	// held on Key + "/.lock".
+	Key string
+
+	// An optional ACL token to use.
+	Token string
+
+	client *http.Client
+}
+
+// NewConsulMasterController returns a new ConsulMasterController that stores
+// the master in the given key.
+func NewConsulMasterController(address, key string) *ConsulMasterController {
+	if address == "" {
+		address = DefaultConsulAddress
+	}
+
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	return &ConsulMasterController{
+		Address: strings.TrimSuffix(address, "/"),
+		Key:     strings.Trim(key, "/"),
+		client:  httpClient,
+	}
+}
+
+// Master returns the node name of the current master.
+func (c *ConsulMasterController) Master() (string, error) {
+	node, _, err := c.get(c.Key)
+	if err != nil {
+		return "", err
+	}
+
+	if node == "" {
+		return "", errNoMaster
+	}
+
+	return node, nil
+}
+
+// SetMaster sets the node to be the new master.
+func (c *ConsulMasterController) SetMaster(node string) error {
+	return c.CompareAndSetMaster("", node)
+}
+
+// CompareAndSetMaster sets the node to be the new master, but only if the
+// current master is expected. If expected is empty, the master is changed
+// regardless of what the current master is.
+func (c *ConsulMasterController) CompareAndSetMaster(expected, node string) error {
+	session, err := c.createSession()
+	if err != nil {
+		return err
+	}
+	defer c.destroySession(session)
+
+	lockKey := c.Key + "/.lock"
+
+	acquired, err := c.put(lockKey, node, url.Values{"acquire": {session}})
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return errMasterLocked
+	}
+	defer c.put(lockKey, node, url.Values{"release": {session}})
+
+	current, index, err := c.get(c.Key)
+	if err != nil {
+		return err
+	}
+
+	if expected != "" && current != expected {
+		return &MasterMismatchError{Expected: expected, Actual: current}
+	}
+
+	// Even though we hold the lock, use a check-and-set so that writes
+	// that don't go through the lock aren't clobbered.
+	ok, err := c.put(c.Key, node, url.Values{"cas": {strconv.FormatUint(index, 10)}})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errMasterConflict
+	}
+
+	return nil
+}
+
+// consulKV is a single entry returned from Consul's /v1/kv endpoint.
+type consulKV struct {
+	Key         string
+	Value       string
+	ModifyIndex uint64
+}
+
+// get returns the value and modify index of the key. If the key does not exist,
+// an empty value and an index of 0 is returned.
+func (c *ConsulMasterController) get(key string) (string, uint64, error) {
+	resp, err := c.do("GET", "/v1/kv/"+key, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", 0, nil
+	}
+
+	var entries []consulKV
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return "", 0, err
+	}
+
+	if len(entries) == 0 {
+		return "", 0, nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(entries[0].Value)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(value), entries[0].ModifyIndex, nil
+}
+
+// put writes the value to the key, returning whether the write succeeded.
+func (c *ConsulMasterController) put(key, value string, params url.Values) (bool, error) {
+	resp, err := c.do("PUT", "/v1/kv/"+key, params, strings.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(raw)) == "true", nil
+}
+
+func (c *ConsulMasterController) createSession() (string, error) {
+	body := strings.NewReader(`{"Name": "rabbitmq-clusterctl", "TTL": "60s"}`)
+
+	resp, err := c.do("PUT", "/v1/session/create", nil, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var session struct {
+		ID string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+
+	return session.ID, nil
+}
+
+func (c *ConsulMasterController) destroySession(id string) error {
+	resp, err := c.do("PUT", "/v1/session/destroy/"+id, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do performs a request against the Consul HTTP API. Responses other than
+// 200 and 404 are returned as errors.
+func (c *ConsulMasterController) do(method, path string, params url.Values, body io.Reader) (*http.Response, error) {
+	u := c.Address + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		defer resp.Body.Close()
+		raw, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("consul: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,234 @@
+package clusterctl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsulMasterController_Master(t *testing.T) {
+	consul := newFakeConsul()
+	s := httptest.NewServer(consul)
+	defer s.Close()
+
+	c := NewConsulMasterController(s.URL, "rabbitmq/master")
+
+	_, err := c.Master()
+	assert.Equal(t, errNoMaster, err)
+
+	consul.set("rabbitmq/master", "rabbit@master")
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@master", node)
+}
+
+func TestConsulMasterController_SetMaster(t *testing.T) {
+	consul := newFakeConsul()
+	s := httptest.NewServer(consul)
+	defer s.Close()
+
+	c := NewConsulMasterController(s.URL, "rabbitmq/master")
+
+	err := c.SetMaster("rabbit@master")
+	assert.NoError(t, err)
+
+	err = c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave", node)
+
+	// The lock should have been released, and the session destroyed.
+	assert.Equal(t, "", consul.lockHolder("rabbitmq/master/.lock"))
+	assert.Equal(t, 0, len(consul.sessions))
+}
+
+func TestConsulMasterController_SetMaster_Locked(t *testing.T) {
+	consul := newFakeConsul()
+	s := httptest.NewServer(consul)
+	defer s.Close()
+
+	c := NewConsulMasterController(s.URL, "rabbitmq/master")
+
+	consul.lock("rabbitmq/master/.lock", "other-session")
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, errMasterLocked, err)
+
+	_, err = c.Master()
+	assert.Equal(t, errNoMaster, err)
+}
+
+func TestConsulMasterController_CompareAndSetMaster(t *testing.T) {
+	consul := newFakeConsul()
+	s := httptest.NewServer(consul)
+	defer s.Close()
+
+	c := NewConsulMasterController(s.URL, "rabbitmq/master")
+	consul.set("rabbitmq/master", "rabbit@master")
+
+	err := c.CompareAndSetMaster("rabbit@other", "rabbit@slave")
+	assert.Equal(t, &MasterMismatchError{Expected: "rabbit@other", Actual: "rabbit@master"}, err)
+
+	err = c.CompareAndSetMaster("rabbit@master", "rabbit@slave")
+	assert.NoError(t, err)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave", node)
+}
+
+func TestConsulMasterController_Token(t *testing.T) {
+	consul := newFakeConsul()
+	consul.token = "secret"
+	s := httptest.NewServer(consul)
+	defer s.Close()
+
+	c := NewConsulMasterController(s.URL, "rabbitmq/master")
+
+	_, err := c.Master()
+	assert.Error(t, err)
+
+	c.Token = "secret"
+	_, err = c.Master()
+	assert.Equal(t, errNoMaster, err)
+}
+
+// fakeConsul is an in memory implementation of the subset of the Consul HTTP
+// API that ConsulMasterController uses.
+type fakeConsul struct {
+	sync.Mutex
+
+	// Required ACL token, if set.
+	token string
+
+	kv       map[string]*fakeConsulKV
+	sessions map[string]bool
+	index    uint64
+}
+
+type fakeConsulKV struct {
+	value       string
+	session     string
+	modifyIndex uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		kv:       make(map[string]*fakeConsulKV),
+		sessions: make(map[string]bool),
+	}
+}
+
+func (f *fakeConsul) set(key, value string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	f.kv[key] = &fakeConsulKV{value: value, modifyIndex: f.index}
+}
+
+func (f *fakeConsul) lock(key, session string) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	f.sessions[session] = true
+	f.kv[key] = &fakeConsulKV{session: session, modifyIndex: f.index}
+}
+
+func (f *fakeConsul) lockHolder(key string) string {
+	f.Lock()
+	defer f.Unlock()
+	if kv, ok := f.kv[key]; ok {
+		return kv.session
+	}
+	return ""
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.token != "" && r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/session/create" && r.Method == "PUT":
+		id := fmt.Sprintf("session-%d", len(f.sessions)+1)
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/") && r.Method == "PUT":
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for _, kv := range f.kv {
+			if kv.session == id {
+				kv.session = ""
+			}
+		}
+		fmt.Fprint(w, "true")
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == "GET":
+		kv, ok := f.kv[strings.TrimPrefix(r.URL.Path, "/v1/kv/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{
+				"Value":       base64.StdEncoding.EncodeToString([]byte(kv.value)),
+				"ModifyIndex": kv.modifyIndex,
+			},
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && r.Method == "PUT":
+		fmt.Fprint(w, f.put(r))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) put(r *http.Request) bool {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	raw, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+
+	kv, ok := f.kv[key]
+	if !ok {
+		kv = &fakeConsulKV{}
+	}
+
+	switch {
+	case q.Get("acquire") != "":
+		session := q.Get("acquire")
+		if !f.sessions[session] || (kv.session != "" && kv.session != session) {
+			return false
+		}
+		kv.session = session
+	case q.Get("release") != "":
+		if kv.session != q.Get("release") {
+			return false
+		}
+		kv.session = ""
+	case q.Get("cas") != "":
+		index, _ := strconv.ParseUint(q.Get("cas"), 10, 64)
+		if index != kv.modifyIndex {
+			return false
+		}
+	}
+
+	f.index++
+	kv.value = string(raw)
+	kv.modifyIndex = f.index
+	f.kv[key] = kv
+	return true
+}
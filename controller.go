@@ -1,40 +1,122 @@
 package clusterctl
 
+import "time"
+
 type Controller struct {
 	// The current nodes name.
 	Node string
 
 	MasterController
 	MembershipController
+
+	// The plan that changes are recorded in, when in dry run mode.
+	plan *Plan
 }
 
-// Joins the current node to the cluster.
-func (c *Controller) Join() error {
+// CurrentMaster returns the current master.
+func (c *Controller) CurrentMaster() (*OperationResult, error) {
+	start := time.Now()
+
 	master, err := c.Master()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return c.JoinNode(JoinNodeOptions{
-		Node:       c.Node,
-		MasterNode: master,
+	r := c.newResult(OperationMaster, start)
+	r.Action = ActionNone
+	r.Master = master
+	return r, nil
+}
+
+// Joins the current node to the cluster as the given type of node. If
+// resetOnFailure is true, the node is reset if joining fails.
+func (c *Controller) Join(nodeType NodeType, resetOnFailure bool) (*OperationResult, error) {
+	start := time.Now()
+
+	master, err := c.Master()
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := c.JoinNode(JoinNodeOptions{
+		Node:           c.Node,
+		MasterNode:     master,
+		Type:           nodeType,
+		ResetOnFailure: resetOnFailure,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.newResult(OperationJoin, start)
+	r.Action = string(action)
+	r.Master = master
+	r.Nodes = c.nodeStates()
+	return r, nil
 }
 
-// Removes the current node from the cluster.
-func (c *Controller) Remove() error {
+// Removes the current node from the cluster. Unless force is true, removal is
+// refused if it could result in data loss.
+func (c *Controller) Remove(force bool) (*OperationResult, error) {
+	start := time.Now()
+
 	master, err := c.Master()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return c.RemoveNode(RemoveNodeOptions{
+	if err := c.RemoveNode(RemoveNodeOptions{
 		Node:       c.Node,
 		MasterNode: master,
-	})
+		Force:      force,
+	}); err != nil {
+		return nil, err
+	}
+
+	r := c.newResult(OperationRemove, start)
+	r.Action = ActionRemoved
+	r.Master = master
+	return r, nil
 }
 
 // Promote promotes this node to be the new master.
-func (c *Controller) Promote() error {
-	return c.SetMaster(c.Node)
+func (c *Controller) Promote() (*OperationResult, error) {
+	start := time.Now()
+
+	// The previous master is informational, and promoting is how a master
+	// that can't be determined (e.g. an ELB with no instances) is fixed, so
+	// an error is ignored.
+	previous, _ := c.Master()
+
+	if err := c.SetMaster(c.Node); err != nil {
+		return nil, err
+	}
+
+	r := c.newResult(OperationPromote, start)
+	r.Action = ActionPromoted
+	r.PreviousMaster = previous
+	r.Master = c.Node
+	r.Nodes = c.nodeStates()
+	return r, nil
+}
+
+// SetType changes the type of the current node.
+func (c *Controller) SetType(nodeType NodeType) (*OperationResult, error) {
+	start := time.Now()
+
+	changed, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+		Node: c.Node,
+		Type: nodeType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.newResult(OperationSetType, start)
+	r.Action = ActionNone
+	if changed {
+		r.Action = ActionTypeChanged
+	}
+	r.Nodes = c.nodeStates()
+	return r, nil
 }
@@ -1,7 +1,10 @@
 package clusterctl
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -18,12 +21,18 @@ func TestController_Join(t *testing.T) {
 
 	master.On("Master").Return("rabbit@master", nil)
 	membership.On("JoinNode", JoinNodeOptions{
-		Node:       "rabbit@slave",
-		MasterNode: "rabbit@master",
-	}).Return(nil)
+		Node:           "rabbit@slave",
+		MasterNode:     "rabbit@master",
+		Type:           NodeTypeRAM,
+		ResetOnFailure: true,
+	}).Return(JoinActionJoined, nil)
 
-	err := c.Join()
+	r, err := c.Join(NodeTypeRAM, true)
 	assert.NoError(t, err)
+	assert.Equal(t, OperationJoin, r.Operation)
+	assert.Equal(t, "rabbit@slave", r.Node)
+	assert.Equal(t, "joined", r.Action)
+	assert.Equal(t, "rabbit@master", r.Master)
 
 	master.AssertExpectations(t)
 	membership.AssertExpectations(t)
@@ -42,10 +51,13 @@ func TestController_Remove(t *testing.T) {
 	membership.On("RemoveNode", RemoveNodeOptions{
 		Node:       "rabbit@slave",
 		MasterNode: "rabbit@master",
+		Force:      true,
 	}).Return(nil)
 
-	err := c.Remove()
+	r, err := c.Remove(true)
 	assert.NoError(t, err)
+	assert.Equal(t, ActionRemoved, r.Action)
+	assert.Equal(t, "rabbit@master", r.Master)
 
 	master.AssertExpectations(t)
 	membership.AssertExpectations(t)
@@ -60,19 +72,92 @@ func TestController_Promote(t *testing.T) {
 		MembershipController: membership,
 	}
 
+	master.On("Master").Return("rabbit@master", nil)
 	master.On("SetMaster", "rabbit@slave").Return(nil)
 
-	err := c.Promote()
+	r, err := c.Promote()
 	assert.NoError(t, err)
+	assert.Equal(t, ActionPromoted, r.Action)
+	assert.Equal(t, "rabbit@master", r.PreviousMaster)
+	assert.Equal(t, "rabbit@slave", r.Master)
+
+	master.AssertExpectations(t)
+}
+
+func TestController_SetType(t *testing.T) {
+	master := new(mockMasterController)
+	membership := new(mockMembershipController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: membership,
+	}
+
+	membership.On("ChangeNodeType", ChangeNodeTypeOptions{
+		Node: "rabbit@slave",
+		Type: NodeTypeRAM,
+	}).Return(true, nil)
+
+	r, err := c.SetType(NodeTypeRAM)
+	assert.NoError(t, err)
+	assert.Equal(t, ActionTypeChanged, r.Action)
+
+	membership.AssertExpectations(t)
+}
+
+func TestController_SetType_AlreadyType(t *testing.T) {
+	master := new(mockMasterController)
+	membership := new(mockMembershipController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: membership,
+	}
+
+	membership.On("ChangeNodeType", ChangeNodeTypeOptions{
+		Node: "rabbit@slave",
+		Type: NodeTypeDisc,
+	}).Return(false, nil)
+
+	r, err := c.SetType(NodeTypeDisc)
+	assert.NoError(t, err)
+	assert.Equal(t, ActionNone, r.Action)
+
+	membership.AssertExpectations(t)
+}
+
+func TestController_Promote_NodeStates(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("", errors.New("no instances"))
+	master.On("SetMaster", "rabbit@slave").Return(nil)
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+
+	r, err := c.Promote()
+	assert.NoError(t, err)
+	assert.Equal(t, "", r.PreviousMaster)
+	assert.Equal(t, []NodeState{
+		{Name: "rabbit@master", Type: NodeTypeDisc, Running: true},
+		{Name: "rabbit@slave", Type: NodeTypeDisc, Running: true},
+	}, r.Nodes)
+
+	master.AssertExpectations(t)
+	m.AssertExpectations(t)
 }
 
 type mockMembershipController struct {
 	mock.Mock
 }
 
-func (m *mockMembershipController) JoinNode(options JoinNodeOptions) error {
+func (m *mockMembershipController) JoinNode(options JoinNodeOptions) (JoinAction, error) {
 	args := m.Called(options)
-	return args.Error(0)
+	return args.Get(0).(JoinAction), args.Error(1)
 }
 
 func (m *mockMembershipController) RemoveNode(options RemoveNodeOptions) error {
@@ -80,6 +165,11 @@ func (m *mockMembershipController) RemoveNode(options RemoveNodeOptions) error {
 	return args.Error(0)
 }
 
+func (m *mockMembershipController) ChangeNodeType(options ChangeNodeTypeOptions) (bool, error) {
+	args := m.Called(options)
+	return args.Bool(0), args.Error(1)
+}
+
 type mockMasterController struct {
 	mock.Mock
 }
@@ -93,3 +183,26 @@ func (m *mockMasterController) SetMaster(node string) error {
 	args := m.Called(node)
 	return args.Error(0)
 }
+
+func TestOperationResult_MarshalJSON(t *testing.T) {
+	r := &OperationResult{
+		Operation: OperationPromote,
+		Node:      "rabbit@slave",
+		Action:    ActionPromoted,
+		Duration:  1500 * time.Millisecond,
+		Master:    "rabbit@slave",
+	}
+
+	raw, err := json.Marshal(r)
+	assert.NoError(t, err)
+
+	var v map[string]interface{}
+	assert.NoError(t, json.Unmarshal(raw, &v))
+	assert.Equal(t, map[string]interface{}{
+		"operation": "promote",
+		"node":      "rabbit@slave",
+		"action":    "promoted",
+		"duration":  "1.5s",
+		"master":    "rabbit@slave",
+	}, v)
+}
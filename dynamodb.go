@@ -0,0 +1,307 @@
+package clusterctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func init() {
+	// dynamodb_lock=<table> takes a lock in the DynamoDB table while
+	// changing the master.
+	RegisterMasterMiddleware("dynamodb_lock", func(m MasterController, value string, opts *MasterOptions) (MasterController, error) {
+		if value == "" {
+			return nil, errors.New("a table name is required")
+		}
+		return DynamoDBLock(m, value), nil
+	})
+}
+
+// DefaultLockKey is the default key of the lock item in DynamoDB.
+const DefaultLockKey = "rabbitmq-clusterctl/master"
+
+// DefaultLockTTL is the default amount of time that a promotion lock is held
+// without being renewed before it's considered abandoned and can be taken by
+// another process.
+const DefaultLockTTL = time.Minute
+
+var errLockLost = errors.New("the lock has expired or was taken by another process")
+
+type dynamodbClient interface {
+	UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+}
+
+// PromotionInProgressError is returned when the master lock is held by another
+// process.
+type PromotionInProgressError struct {
+	Owner   string
+	Expires time.Time
+}
+
+// Error implements the error interface.
+func (e *PromotionInProgressError) Error() string {
+	return fmt.Sprintf("promotion in progress by %s (lock expires at %s)", e.Owner, e.Expires.UTC().Format(time.RFC3339))
+}
+
+// LockLostError is returned when the promotion lock couldn't be renewed while
+// the master was being changed. The master was changed, but another process
+// may have taken the lock and changed it at the same time.
+type LockLostError struct {
+	Node string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *LockLostError) Error() string {
+	return fmt.Sprintf("the master was set to %s, but the promotion lock was lost while setting it, so another promotion may have run concurrently: %v", e.Node, e.Err)
+}
+
+// Unwrap returns the error from renewing the lock.
+func (e *LockLostError) Unwrap() error {
+	return e.Err
+}
+
+// dynamodbLockMasterController is a MasterController middleware that takes a
+// lock in DynamoDB before changing the master, so that concurrent promotions
+// fail fast instead of the last writer winning.
+//
+// The lock is a single item in a table with a string hash key named LockID.
+// Each time the lock is taken, the item's fencing token is incremented, and
+// the lock is only renewed or released if the token hasn't changed, so a
+// process whose lock expired can't extend or release a lock that was since
+// taken by another process. The token isn't passed to the wrapped
+// MasterController, so it doesn't fence the change itself; instead the lock
+// is renewed while the change is made.
+type dynamodbLockMasterController struct {
+	MasterController
+	dynamodb dynamodbClient
+
+	// The DynamoDB table that the lock item is stored in.
+	table string
+
+	// The key of the lock item.
+	key string
+
+	// Identifies this process in the lock item.
+	owner string
+
+	// The amount of time before the lock expires, unless it's renewed.
+	ttl time.Duration
+
+	// The amount of time between renewals of the lock. The default is a
+	// third of the ttl.
+	renewInterval time.Duration
+
+	now func() time.Time
+}
+
+// DynamoDBLock wraps the MasterController with middleware that holds a lock in
+// the given DynamoDB table while changing the master.
+func DynamoDBLock(m MasterController, table string) MasterController {
+	return &dynamodbLockMasterController{
+		MasterController: m,
+		dynamodb:         dynamodb.New(session.New()),
+		table:            table,
+		key:              DefaultLockKey,
+		owner:            lockOwner(),
+		ttl:              DefaultLockTTL,
+		now:              time.Now,
+	}
+}
+
+// Unwrap returns the wrapped MasterController.
+func (c *dynamodbLockMasterController) Unwrap() MasterController {
+	return c.MasterController
+}
+
+// dryRun implements the dryRunner interface.
+func (c *dynamodbLockMasterController) dryRun(plan *Plan) {
+	c.dynamodb = &recordingDynamoDBClient{dynamodbClient: c.dynamodb, plan: plan}
+	c.MasterController = dryRunMaster(c.MasterController, plan)
+}
+
+// recordingDynamoDBClient is a dynamodbClient that records changes to items in
+// a Plan, instead of making them. Since nothing is written, recorded updates
+// always succeed, even if the lock is currently held.
+type recordingDynamoDBClient struct {
+	dynamodbClient
+	plan *Plan
+}
+
+func (c *recordingDynamoDBClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	c.plan.Record("dynamodb", "UpdateItem %s %s", aws.StringValue(input.TableName), aws.StringValue(input.UpdateExpression))
+	return &dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"FencingToken": {N: aws.String("0")},
+		},
+	}, nil
+}
+
+// SetMaster takes the lock, sets the new master, then releases the lock. The
+// lock is renewed while the master is being set, so that a slow change (e.g.
+// waiting for queues to synchronise) doesn't outlive it. If the lock can't be
+// renewed, a *LockLostError is returned once the wrapped SetMaster returns.
+func (c *dynamodbLockMasterController) SetMaster(node string) error {
+	token, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer c.unlock(token)
+
+	stop := make(chan struct{})
+	renewErr := make(chan error, 1)
+	go func() {
+		renewErr <- c.heartbeat(token, stop)
+	}()
+
+	err = c.MasterController.SetMaster(node)
+	close(stop)
+
+	if lost := <-renewErr; lost != nil && err == nil {
+		return &LockLostError{Node: node, Err: lost}
+	}
+
+	return err
+}
+
+// heartbeat renews the lock until stop is closed, returning the error if it
+// can't be renewed.
+func (c *dynamodbLockMasterController) heartbeat(token string, stop <-chan struct{}) error {
+	interval := c.renewInterval
+	if interval == 0 {
+		interval = c.ttl / 3
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+
+		if err := c.renew(token); err != nil {
+			return err
+		}
+	}
+}
+
+// lock takes the lock if it's not held, or has expired, returning the new
+// fencing token.
+func (c *dynamodbLockMasterController) lock() (string, error) {
+	now := c.now()
+
+	resp, err := c.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.table),
+		Key:                 c.itemKey(),
+		UpdateExpression:    aws.String("SET #owner = :owner, Expires = :expires ADD FencingToken :one"),
+		ConditionExpression: aws.String("attribute_not_exists(LockID) OR Expires < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":   {S: aws.String(c.owner)},
+			":expires": unixAttribute(now.Add(c.ttl)),
+			":now":     unixAttribute(now),
+			":one":     {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return "", c.inProgress()
+		}
+		return "", err
+	}
+
+	return aws.StringValue(resp.Attributes["FencingToken"].N), nil
+}
+
+// renew extends the expiry of the lock, but only if it's still held with the
+// given fencing token and hasn't expired.
+func (c *dynamodbLockMasterController) renew(token string) error {
+	now := c.now()
+
+	_, err := c.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.table),
+		Key:                 c.itemKey(),
+		UpdateExpression:    aws.String("SET Expires = :expires"),
+		ConditionExpression: aws.String("FencingToken = :token AND Expires >= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": unixAttribute(now.Add(c.ttl)),
+			":now":     unixAttribute(now),
+			":token":   {N: aws.String(token)},
+		},
+	})
+	if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errLockLost
+	}
+
+	return err
+}
+
+// unlock releases the lock, but only if it's still held with the given fencing
+// token. The item is kept, so that fencing tokens always increase.
+func (c *dynamodbLockMasterController) unlock(token string) error {
+	_, err := c.dynamodb.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(c.table),
+		Key:                 c.itemKey(),
+		UpdateExpression:    aws.String("SET Expires = :zero"),
+		ConditionExpression: aws.String("FencingToken = :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":  {N: aws.String("0")},
+			":token": {N: aws.String(token)},
+		},
+	})
+
+	return err
+}
+
+// inProgress returns an error describing the current holder of the lock.
+func (c *dynamodbLockMasterController) inProgress() error {
+	resp, err := c.dynamodb.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            c.itemKey(),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	e := &PromotionInProgressError{Owner: "unknown"}
+	if owner, ok := resp.Item["Owner"]; ok {
+		e.Owner = aws.StringValue(owner.S)
+	}
+	if expires, ok := resp.Item["Expires"]; ok {
+		seconds, _ := strconv.ParseInt(aws.StringValue(expires.N), 10, 64)
+		e.Expires = time.Unix(seconds, 0)
+	}
+
+	return e
+}
+
+func (c *dynamodbLockMasterController) itemKey() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"LockID": {S: aws.String(c.key)},
+	}
+}
+
+func unixAttribute(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
+// lockOwner returns a string that identifies this process.
+func lockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s[%d]", hostname, os.Getpid())
+}
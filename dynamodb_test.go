@@ -0,0 +1,193 @@
+package clusterctl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDynamoDBLockMasterController_SetMaster(t *testing.T) {
+	client := new(mockDynamoDBClient)
+	master := new(mockMasterController)
+	c := newTestDynamoDBLock(master, client)
+
+	client.On("UpdateItem", lockInput()).Return(&dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"FencingToken": {N: aws.String("42")},
+		},
+	}, nil)
+	master.On("SetMaster", "rabbit@slave").Return(nil)
+	client.On("UpdateItem", unlockInput("42")).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+
+	client.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestDynamoDBLockMasterController_SetMaster_InProgress(t *testing.T) {
+	client := new(mockDynamoDBClient)
+	master := new(mockMasterController)
+	c := newTestDynamoDBLock(master, client)
+
+	client.On("UpdateItem", lockInput()).Return(&dynamodb.UpdateItemOutput{}, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil))
+	client.On("GetItem", &dynamodb.GetItemInput{
+		TableName:      aws.String("locks"),
+		Key:            map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(DefaultLockKey)}},
+		ConsistentRead: aws.Bool(true),
+	}).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"Owner":   {S: aws.String("ip-10-0-0-2[123]")},
+			"Expires": {N: aws.String("1000600")},
+		},
+	}, nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, &PromotionInProgressError{Owner: "ip-10-0-0-2[123]", Expires: time.Unix(1000600, 0)}, err)
+	assert.Contains(t, err.Error(), "promotion in progress by ip-10-0-0-2[123]")
+
+	client.AssertExpectations(t)
+	master.AssertNotCalled(t, "SetMaster", "rabbit@slave")
+}
+
+func TestDynamoDBLockMasterController_SetMaster_Error(t *testing.T) {
+	client := new(mockDynamoDBClient)
+	master := new(mockMasterController)
+	c := newTestDynamoDBLock(master, client)
+
+	client.On("UpdateItem", lockInput()).Return(&dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"FencingToken": {N: aws.String("1")},
+		},
+	}, nil)
+	master.On("SetMaster", "rabbit@slave").Return(errNoInstances)
+	client.On("UpdateItem", unlockInput("1")).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, errNoInstances, err)
+
+	// The lock should still be released.
+	client.AssertExpectations(t)
+}
+
+func TestDynamoDBLockMasterController_SetMaster_Renew(t *testing.T) {
+	client := new(mockDynamoDBClient)
+	master := new(mockMasterController)
+	c := newTestDynamoDBLock(master, client)
+	c.renewInterval = 5 * time.Millisecond
+
+	client.On("UpdateItem", lockInput()).Return(&dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"FencingToken": {N: aws.String("42")},
+		},
+	}, nil)
+	client.On("UpdateItem", renewInput("42")).Return(&dynamodb.UpdateItemOutput{}, nil)
+	master.On("SetMaster", "rabbit@slave").Return(nil).After(50 * time.Millisecond)
+	client.On("UpdateItem", unlockInput("42")).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+
+	client.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestDynamoDBLockMasterController_SetMaster_LockLost(t *testing.T) {
+	client := new(mockDynamoDBClient)
+	master := new(mockMasterController)
+	c := newTestDynamoDBLock(master, client)
+	c.renewInterval = 5 * time.Millisecond
+
+	client.On("UpdateItem", lockInput()).Return(&dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{
+			"FencingToken": {N: aws.String("42")},
+		},
+	}, nil)
+	client.On("UpdateItem", renewInput("42")).Return(&dynamodb.UpdateItemOutput{}, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil))
+	master.On("SetMaster", "rabbit@slave").Return(nil).After(50 * time.Millisecond)
+	client.On("UpdateItem", unlockInput("42")).Return(&dynamodb.UpdateItemOutput{}, nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, &LockLostError{Node: "rabbit@slave", Err: errLockLost}, err)
+
+	client.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func newTestDynamoDBLock(m MasterController, client dynamodbClient) *dynamodbLockMasterController {
+	return &dynamodbLockMasterController{
+		MasterController: m,
+		dynamodb:         client,
+		table:            "locks",
+		key:              DefaultLockKey,
+		owner:            "ip-10-0-0-1[1]",
+		ttl:              10 * time.Minute,
+		now:              func() time.Time { return time.Unix(1000000, 0) },
+	}
+}
+
+func lockInput() *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:           aws.String("locks"),
+		Key:                 map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(DefaultLockKey)}},
+		UpdateExpression:    aws.String("SET #owner = :owner, Expires = :expires ADD FencingToken :one"),
+		ConditionExpression: aws.String("attribute_not_exists(LockID) OR Expires < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("Owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":   {S: aws.String("ip-10-0-0-1[1]")},
+			":expires": {N: aws.String("1000600")},
+			":now":     {N: aws.String("1000000")},
+			":one":     {N: aws.String("1")},
+		},
+		ReturnValues: aws.String("ALL_NEW"),
+	}
+}
+
+func renewInput(token string) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:           aws.String("locks"),
+		Key:                 map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(DefaultLockKey)}},
+		UpdateExpression:    aws.String("SET Expires = :expires"),
+		ConditionExpression: aws.String("FencingToken = :token AND Expires >= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": {N: aws.String("1000600")},
+			":now":     {N: aws.String("1000000")},
+			":token":   {N: aws.String(token)},
+		},
+	}
+}
+
+func unlockInput(token string) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
+		TableName:           aws.String("locks"),
+		Key:                 map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(DefaultLockKey)}},
+		UpdateExpression:    aws.String("SET Expires = :zero"),
+		ConditionExpression: aws.String("FencingToken = :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero":  {N: aws.String("0")},
+			":token": {N: aws.String(token)},
+		},
+	}
+}
+
+type mockDynamoDBClient struct {
+	mock.Mock
+}
+
+func (m *mockDynamoDBClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*dynamodb.UpdateItemOutput), args.Error(1)
+}
+
+func (m *mockDynamoDBClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
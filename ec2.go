@@ -0,0 +1,114 @@
+package clusterctl
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// This file contains helpers for mapping between ec2 instances and the
+// hostnames that rabbitmq nodes use, which are the private dns names of the
+// instances.
+
+var (
+	errNoInstance  = errors.New("no ec2 instance found")
+	errNoPrivateIP = errors.New("ec2 instance does not have a PrivateIpAddress")
+)
+
+const (
+	filterPrivateDnsName   = "private-dns-name"
+	filterPrivateIpAddress = "private-ip-address"
+)
+
+// instanceHostname returns the private dns name for the ec2 instance.
+func instanceHostname(c ec2Client, id string) (string, error) {
+	instance, err := describeInstance(c, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if instance.PrivateDnsName == nil {
+		return "", errNoPrivateDNS
+	}
+
+	return *instance.PrivateDnsName, nil
+}
+
+// instanceWithHostname returns the id of the ec2 instance with the given
+// private dns name.
+func instanceWithHostname(c ec2Client, hostname string) (string, error) {
+	instance, err := describeInstance(c, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(filterPrivateDnsName),
+				Values: []*string{aws.String(hostname)},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *instance.InstanceId, nil
+}
+
+// describeInstance returns the first instance matching the input.
+func describeInstance(c ec2Client, input *ec2.DescribeInstancesInput) (*ec2.Instance, error) {
+	resp, err := c.DescribeInstances(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil, errNoInstance
+	}
+
+	return resp.Reservations[0].Instances[0], nil
+}
+
+// ipHostname returns the private dns name of the ec2 instance with the given
+// private ip address.
+func ipHostname(c ec2Client, ip string) (string, error) {
+	instance, err := describeInstance(c, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(filterPrivateIpAddress),
+				Values: []*string{aws.String(ip)},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if instance.PrivateDnsName == nil {
+		return "", errNoPrivateDNS
+	}
+
+	return *instance.PrivateDnsName, nil
+}
+
+// hostnameIP returns the private ip address of the ec2 instance with the given
+// private dns name.
+func hostnameIP(c ec2Client, hostname string) (string, error) {
+	instance, err := describeInstance(c, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(filterPrivateDnsName),
+				Values: []*string{aws.String(hostname)},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if instance.PrivateIpAddress == nil {
+		return "", errNoPrivateIP
+	}
+
+	return *instance.PrivateIpAddress, nil
+}
@@ -0,0 +1,372 @@
+package clusterctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEtcdEndpoint is the default etcd endpoint.
+const DefaultEtcdEndpoint = "http://127.0.0.1:2379"
+
+// DefaultLeaseTTL is the default TTL of the lease that's held by the master
+// when using EtcdMasterController.Campaign.
+const DefaultLeaseTTL = 15 * time.Second
+
+func init() {
+	// etcd://<endpoint>/<key>?lease_ttl=15s
+	RegisterMaster("etcd", func(u *MasterURL) (MasterController, error) {
+		m := NewEtcdMasterController(u.Host(), u.Path())
+
+		ttl, err := u.Duration("lease_ttl", DefaultLeaseTTL)
+		if err != nil {
+			return nil, err
+		}
+		m.LeaseTTL = ttl
+
+		return m, nil
+	})
+}
+
+// EtcdMasterController implements the MasterController interface using a key
+// in etcd as the source of truth. All changes to the master are made with a
+// transactional compare-and-set, so concurrent changes are fenced. It talks to
+// etcd using the v3 JSON gateway, so no gRPC client is required.
+type EtcdMasterController struct {
+	// The etcd endpoint (e.g. http://127.0.0.1:2379).
+	Endpoint string
+
+	// The key that stores the node name of the master.
+	Key string
+
+	// The TTL of the lease that's held while campaigning. The default is
+	// DefaultLeaseTTL.
+	LeaseTTL time.Duration
+
+	client *http.Client
+}
+
+// NewEtcdMasterController returns a new EtcdMasterController that stores the
+// master in the given key.
+func NewEtcdMasterController(endpoint, key string) *EtcdMasterController {
+	if endpoint == "" {
+		endpoint = DefaultEtcdEndpoint
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	return &EtcdMasterController{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Key:      key,
+		LeaseTTL: DefaultLeaseTTL,
+		client:   httpClient,
+	}
+}
+
+// Master returns the node name of the current master.
+func (c *EtcdMasterController) Master() (string, error) {
+	kv, err := c.get()
+	if err != nil {
+		return "", err
+	}
+
+	if kv == nil {
+		return "", errNoMaster
+	}
+
+	return kv.value, nil
+}
+
+// SetMaster sets the node to be the new master. The write only succeeds if the
+// key hasn't been modified since it was read.
+func (c *EtcdMasterController) SetMaster(node string) error {
+	kv, err := c.get()
+	if err != nil {
+		return err
+	}
+
+	var revision int64
+	if kv != nil {
+		revision = kv.modRevision
+	}
+
+	ok, err := c.txn(etcdCompare{
+		Key:         c.encodedKey(),
+		Target:      "MOD",
+		Result:      "EQUAL",
+		ModRevision: strconv.FormatInt(revision, 10),
+	}, node, 0)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errMasterConflict
+	}
+
+	return nil
+}
+
+// CompareAndSetMaster sets the node to be the new master, but only if the
+// current master is expected.
+func (c *EtcdMasterController) CompareAndSetMaster(expected, node string) error {
+	ok, err := c.txn(etcdCompare{
+		Key:    c.encodedKey(),
+		Target: "VALUE",
+		Result: "EQUAL",
+		Value:  base64.StdEncoding.EncodeToString([]byte(expected)),
+	}, node, 0)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		actual, err := c.Master()
+		if err != nil && err != errNoMaster {
+			return err
+		}
+		return &MasterMismatchError{Expected: expected, Actual: actual}
+	}
+
+	return nil
+}
+
+// Campaign blocks until the node is elected master, or the context is
+// cancelled. The node is elected when no other node holds the master key. Once
+// elected, the key is attached to a lease that is kept alive until the context
+// is cancelled, at which point the lease is revoked and the key is deleted so
+// that another node can be elected.
+//
+// The returned channel is closed when the node is no longer master: because
+// the context was cancelled, the lease could not be kept alive, or the key was
+// changed to another node. In each case the lease is revoked.
+func (c *EtcdMasterController) Campaign(ctx context.Context, node string) (<-chan struct{}, error) {
+	ttl := c.LeaseTTL
+	if ttl == 0 {
+		ttl = DefaultLeaseTTL
+	}
+
+	lease, err := c.grant(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Only put the key if it doesn't already exist.
+		ok, err := c.txn(etcdCompare{
+			Key:            c.encodedKey(),
+			Target:         "CREATE",
+			Result:         "EQUAL",
+			CreateRevision: "0",
+		}, node, lease)
+		if err != nil {
+			c.revoke(lease)
+			return nil, err
+		}
+
+		if ok {
+			break
+		}
+
+		// Keep our lease alive while we wait for the current master's
+		// key to be deleted.
+		if err := c.keepAlive(lease); err != nil {
+			c.revoke(lease)
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			c.revoke(lease)
+			return nil, ctx.Err()
+		case <-time.After(ttl / 3):
+		}
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+
+		for {
+			select {
+			case <-ctx.Done():
+				c.revoke(lease)
+				return
+			case <-time.After(ttl / 3):
+			}
+
+			if err := c.keepAlive(lease); err != nil {
+				c.revoke(lease)
+				return
+			}
+
+			// The key is checked each time the lease is renewed, so
+			// that a master set by someone else (e.g. with SetMaster)
+			// is noticed. Failing to read the key isn't a change.
+			if kv, err := c.get(); err == nil && (kv == nil || kv.value != node) {
+				c.revoke(lease)
+				return
+			}
+		}
+	}()
+
+	return lost, nil
+}
+
+func (c *EtcdMasterController) encodedKey() string {
+	return base64.StdEncoding.EncodeToString([]byte(c.Key))
+}
+
+// etcdKV is a decoded key value pair.
+type etcdKV struct {
+	value       string
+	modRevision int64
+}
+
+// get returns the master key, or nil if it doesn't exist.
+func (c *EtcdMasterController) get() (*etcdKV, error) {
+	var resp struct {
+		Kvs []struct {
+			Value       string `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+
+	if err := c.post("/v3/kv/range", map[string]string{"key": c.encodedKey()}, &resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	value, err := base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, _ := strconv.ParseInt(resp.Kvs[0].ModRevision, 10, 64)
+
+	return &etcdKV{
+		value:       string(value),
+		modRevision: revision,
+	}, nil
+}
+
+// etcdCompare is a single comparison in a transaction.
+type etcdCompare struct {
+	Key            string `json:"key"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	ModRevision    string `json:"mod_revision,omitempty"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          string `json:"value,omitempty"`
+}
+
+// txn puts the node in the master key if the comparison succeeds, returning
+// whether it succeeded. If lease is non-zero, the key is attached to the lease.
+func (c *EtcdMasterController) txn(compare etcdCompare, node string, lease int64) (bool, error) {
+	put := map[string]string{
+		"key":   c.encodedKey(),
+		"value": base64.StdEncoding.EncodeToString([]byte(node)),
+	}
+	if lease != 0 {
+		put["lease"] = strconv.FormatInt(lease, 10)
+	}
+
+	req := map[string]interface{}{
+		"compare": []etcdCompare{compare},
+		"success": []interface{}{
+			map[string]interface{}{"request_put": put},
+		},
+	}
+
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+
+	if err := c.post("/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+// grant creates a new lease with the given TTL.
+func (c *EtcdMasterController) grant(ttl time.Duration) (int64, error) {
+	var resp struct {
+		ID string `json:"ID"`
+	}
+
+	// etcd leases have a granularity of 1 second.
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	req := map[string]string{"TTL": strconv.FormatInt(seconds, 10)}
+	if err := c.post("/v3/lease/grant", req, &resp); err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(resp.ID, 10, 64)
+}
+
+// keepAlive renews the lease.
+func (c *EtcdMasterController) keepAlive(lease int64) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+
+	req := map[string]string{"ID": strconv.FormatInt(lease, 10)}
+	if err := c.post("/v3/lease/keepalive", req, &resp); err != nil {
+		return err
+	}
+
+	// An expired lease is reported with a TTL of 0 (or not at all).
+	if ttl, _ := strconv.Atoi(resp.Result.TTL); ttl <= 0 {
+		return fmt.Errorf("etcd: lease %d has expired", lease)
+	}
+
+	return nil
+}
+
+// revoke revokes the lease, deleting any keys attached to it.
+func (c *EtcdMasterController) revoke(lease int64) error {
+	req := map[string]string{"ID": strconv.FormatInt(lease, 10)}
+	return c.post("/v3/lease/revoke", req, nil)
+}
+
+// post performs a request against the etcd v3 JSON gateway.
+func (c *EtcdMasterController) post(path string, req interface{}, v interface{}) error {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Post(c.Endpoint+path, "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("etcd: %s: %s: %s", path, resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	// The keepalive endpoint streams responses, so only decode the first.
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,96 @@
+//go:build integration
+// +build integration
+
+package clusterctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests run against a real etcd, with the v3 JSON gateway at
+// $ETCD_ENDPOINT:
+//
+//	go test -tags integration -run Etcd
+func newIntegrationEtcdMasterController(t *testing.T) *EtcdMasterController {
+	endpoint := os.Getenv("ETCD_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("$ETCD_ENDPOINT is not set")
+	}
+
+	key := fmt.Sprintf("/rabbitmq-clusterctl-test/%d/master", time.Now().UnixNano())
+	c := NewEtcdMasterController(endpoint, key)
+	c.LeaseTTL = 2 * time.Second
+	return c
+}
+
+func TestEtcdIntegration_Campaign(t *testing.T) {
+	a := newIntegrationEtcdMasterController(t)
+	b := NewEtcdMasterController(a.Endpoint, a.Key)
+	b.LeaseTTL = a.LeaseTTL
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	lostA, err := a.Campaign(ctxA, "rabbit@a")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	elected := make(chan struct{})
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go func() {
+		if _, err := b.Campaign(ctxB, "rabbit@b"); err == nil {
+			close(elected)
+		}
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("expected b to not be elected while a is master")
+	case <-time.After(2 * a.LeaseTTL):
+	}
+
+	cancelA()
+	<-lostA
+
+	select {
+	case <-elected:
+	case <-time.After(5 * a.LeaseTTL):
+		t.Fatal("expected b to be elected")
+	}
+
+	node, err := b.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@b", node)
+}
+
+func TestEtcdIntegration_Campaign_KeyChanged(t *testing.T) {
+	c := newIntegrationEtcdMasterController(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lost, err := c.Campaign(ctx, "rabbit@a")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, c.SetMaster("rabbit@b"))
+
+	select {
+	case <-lost:
+	case <-time.After(2 * c.LeaseTTL):
+		t.Fatal("expected leadership to be lost when the key changed")
+	}
+
+	// Revoking the lease doesn't delete a key that was replaced.
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@b", node)
+}
@@ -0,0 +1,325 @@
+package clusterctl
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtcdMasterController_Master(t *testing.T) {
+	etcd := newFakeEtcd()
+	s := httptest.NewServer(etcd)
+	defer s.Close()
+
+	c := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+
+	_, err := c.Master()
+	assert.Equal(t, errNoMaster, err)
+
+	etcd.put("/rabbitmq/master", "rabbit@master", 0)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@master", node)
+}
+
+func TestEtcdMasterController_SetMaster(t *testing.T) {
+	etcd := newFakeEtcd()
+	s := httptest.NewServer(etcd)
+	defer s.Close()
+
+	c := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+
+	err := c.SetMaster("rabbit@master")
+	assert.NoError(t, err)
+
+	err = c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave", node)
+}
+
+func TestEtcdMasterController_SetMaster_Conflict(t *testing.T) {
+	etcd := newFakeEtcd()
+	s := httptest.NewServer(etcd)
+	defer s.Close()
+
+	c := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+	etcd.put("/rabbitmq/master", "rabbit@master", 0)
+
+	// Simulate another process changing the master between our read and
+	// write.
+	etcd.beforeTxn = func() {
+		etcd.put("/rabbitmq/master", "rabbit@other", 0)
+	}
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, errMasterConflict, err)
+}
+
+func TestEtcdMasterController_CompareAndSetMaster(t *testing.T) {
+	etcd := newFakeEtcd()
+	s := httptest.NewServer(etcd)
+	defer s.Close()
+
+	c := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+	etcd.put("/rabbitmq/master", "rabbit@master", 0)
+
+	err := c.CompareAndSetMaster("rabbit@other", "rabbit@slave")
+	assert.Equal(t, &MasterMismatchError{Expected: "rabbit@other", Actual: "rabbit@master"}, err)
+
+	err = c.CompareAndSetMaster("rabbit@master", "rabbit@slave")
+	assert.NoError(t, err)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave", node)
+}
+
+func TestEtcdMasterController_Campaign(t *testing.T) {
+	etcd := newFakeEtcd()
+	s := httptest.NewServer(etcd)
+	defer s.Close()
+
+	a := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+	a.LeaseTTL = 30 * time.Millisecond
+	b := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+	b.LeaseTTL = 30 * time.Millisecond
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	lostA, err := a.Campaign(ctxA, "rabbit@a")
+	assert.NoError(t, err)
+
+	node, err := a.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@a", node)
+
+	// b can't be elected while a holds the lease.
+	elected := make(chan struct{})
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go func() {
+		if _, err := b.Campaign(ctxB, "rabbit@b"); err == nil {
+			close(elected)
+		}
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("expected b to not be elected while a is master")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// When a resigns, b should be elected.
+	cancelA()
+	<-lostA
+
+	select {
+	case <-elected:
+	case <-time.After(time.Second):
+		t.Fatal("expected b to be elected")
+	}
+
+	node, err = b.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@b", node)
+}
+
+func TestEtcdMasterController_Campaign_Lost(t *testing.T) {
+	tests := []struct {
+		name string
+		lose func(etcd *fakeEtcd, lease int64)
+	}{
+		{"key changed", func(etcd *fakeEtcd, lease int64) {
+			etcd.put("/rabbitmq/master", "rabbit@other", 0)
+		}},
+		{"lease expired", func(etcd *fakeEtcd, lease int64) {
+			delete(etcd.leases, lease)
+		}},
+	}
+
+	for _, tt := range tests {
+		etcd := newFakeEtcd()
+		s := httptest.NewServer(etcd)
+
+		c := NewEtcdMasterController(s.URL, "/rabbitmq/master")
+		c.LeaseTTL = 30 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		lost, err := c.Campaign(ctx, "rabbit@a")
+		assert.NoError(t, err)
+
+		etcd.Lock()
+		lease := etcd.kv["/rabbitmq/master"].lease
+		tt.lose(etcd, lease)
+		etcd.Unlock()
+
+		select {
+		case <-lost:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: expected leadership to be lost", tt.name)
+		}
+
+		// The lease is revoked, so it no longer holds any keys.
+		etcd.Lock()
+		_, ok := etcd.leases[lease]
+		assert.False(t, ok, tt.name)
+		for _, kv := range etcd.kv {
+			assert.NotEqual(t, lease, kv.lease, tt.name)
+		}
+		etcd.Unlock()
+
+		cancel()
+		s.Close()
+	}
+}
+
+// fakeEtcd is an in memory implementation of the subset of the etcd v3 JSON
+// gateway that EtcdMasterController uses. Lease expiry is not simulated.
+type fakeEtcd struct {
+	sync.Mutex
+
+	kv       map[string]*fakeEtcdKV
+	leases   map[int64]bool
+	revision int64
+
+	// Called before a transaction is processed.
+	beforeTxn func()
+}
+
+type fakeEtcdKV struct {
+	value          string
+	createRevision int64
+	modRevision    int64
+	lease          int64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		kv:     make(map[string]*fakeEtcdKV),
+		leases: make(map[int64]bool),
+	}
+}
+
+func (f *fakeEtcd) put(key, value string, lease int64) {
+	f.revision++
+	kv, ok := f.kv[key]
+	if !ok {
+		kv = &fakeEtcdKV{createRevision: f.revision}
+		f.kv[key] = kv
+	}
+	kv.value = value
+	kv.modRevision = f.revision
+	kv.lease = lease
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/kv/txn" && f.beforeTxn != nil {
+		f.beforeTxn()
+		f.beforeTxn = nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	var req map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&req)
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var key string
+		json.Unmarshal(req["key"], &key)
+		resp := map[string]interface{}{}
+		if kv, ok := f.kv[decode(key)]; ok {
+			resp["kvs"] = []map[string]string{
+				{
+					"key":          key,
+					"value":        base64.StdEncoding.EncodeToString([]byte(kv.value)),
+					"mod_revision": strconv.FormatInt(kv.modRevision, 10),
+				},
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/v3/kv/txn":
+		var compare []etcdCompare
+		json.Unmarshal(req["compare"], &compare)
+		var success []struct {
+			RequestPut struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Lease string `json:"lease"`
+			} `json:"request_put"`
+		}
+		json.Unmarshal(req["success"], &success)
+
+		ok := f.compare(compare[0])
+		if ok {
+			put := success[0].RequestPut
+			lease, _ := strconv.ParseInt(put.Lease, 10, 64)
+			f.put(decode(put.Key), decode(put.Value), lease)
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"succeeded": ok})
+	case "/v3/lease/grant":
+		id := int64(len(f.leases) + 1)
+		f.leases[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": strconv.FormatInt(id, 10), "TTL": "1"})
+	case "/v3/lease/keepalive":
+		id := f.leaseID(req)
+		ttl := "0"
+		if f.leases[id] {
+			ttl = "1"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"TTL": ttl}})
+	case "/v3/lease/revoke":
+		id := f.leaseID(req)
+		delete(f.leases, id)
+		for key, kv := range f.kv {
+			if kv.lease == id {
+				delete(f.kv, key)
+			}
+		}
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeEtcd) compare(c etcdCompare) bool {
+	kv, ok := f.kv[decode(c.Key)]
+	if !ok {
+		kv = &fakeEtcdKV{}
+	}
+
+	switch c.Target {
+	case "MOD":
+		return strconv.FormatInt(kv.modRevision, 10) == c.ModRevision
+	case "CREATE":
+		return strconv.FormatInt(kv.createRevision, 10) == c.CreateRevision
+	case "VALUE":
+		return ok && kv.value == decode(c.Value)
+	default:
+		return false
+	}
+}
+
+func (f *fakeEtcd) leaseID(req map[string]json.RawMessage) int64 {
+	var id string
+	json.Unmarshal(req["ID"], &id)
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
+
+func decode(s string) string {
+	raw, _ := base64.StdEncoding.DecodeString(s)
+	return string(raw)
+}
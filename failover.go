@@ -0,0 +1,327 @@
+package clusterctl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultReconnectTimeout is the default amount of time to wait for clients to
+// reconnect to the new master after a failover.
+const DefaultReconnectTimeout = 2 * time.Minute
+
+// Operation and action reported in the OperationResult of a failover.
+const (
+	OperationFailover = "failover"
+	ActionFailedOver  = "failed_over"
+)
+
+var (
+	errNoFailoverCandidate     = errors.New("no running node without alarms to fail over to")
+	errNoSynchronisedCandidate = errors.New("no running node without alarms is fully synchronised to fail over to")
+)
+
+// FailoverController is an interface for handing over the master role from
+// one node to another.
+type FailoverController interface {
+	StatusController
+	QueueStatusController
+
+	// SynchroniseQueues synchronises all queues that have an
+	// unsynchronised mirror on the node, and waits for synchronisation to
+	// complete.
+	SynchroniseQueues(node string) error
+
+	// TransferLeadership transfers the leadership of quorum queues that
+	// the node is a member of to the node.
+	TransferLeadership(node string) error
+
+	// Connections returns the number of client connections to each node in
+	// the cluster, as seen from the given node.
+	Connections(node string) (map[string]int, error)
+
+	// WaitForConnections waits until more than baseline clients are
+	// connected to the node.
+	WaitForConnections(node string, baseline int, timeout time.Duration) error
+}
+
+// FailoverOptions are the options for a failover.
+type FailoverOptions struct {
+	// The node to hand over to. If empty, the best candidate is picked.
+	To string
+
+	// The maximum amount of time to wait for clients to reconnect to the
+	// new master. The default is DefaultReconnectTimeout.
+	ReconnectTimeout time.Duration
+}
+
+// FailoverTargetError is returned when the node given to fail over to can't be
+// the master.
+type FailoverTargetError struct {
+	Node   string
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *FailoverTargetError) Error() string {
+	return fmt.Sprintf("cannot fail over to %s: %s", e.Node, e.Reason)
+}
+
+// ClientsNotReconnectedError is returned when no clients connect to the new
+// master after a failover.
+type ClientsNotReconnectedError struct {
+	Node    string
+	Timeout time.Duration
+}
+
+// Error implements the error interface.
+func (e *ClientsNotReconnectedError) Error() string {
+	return fmt.Sprintf("no clients reconnected to %s within %v", e.Node, e.Timeout)
+}
+
+// Failover hands over the master role to another node, and can be run from any
+// member of the cluster. Queues are synchronised to the new master before the
+// master is changed, and leadership of quorum queues is transferred to it once
+// the master has been changed, so that a master that can't be changed leaves
+// the queues where they were. If clients were connected to the old master,
+// Failover then waits for them to reconnect to the new master.
+//
+// If leadership can't be transferred, or clients don't reconnect, the error
+// (a *ClientsNotReconnectedError for the latter) is returned along with the
+// result, since the master has already been changed.
+func (c *Controller) Failover(options FailoverOptions) (*OperationResult, error) {
+	start := time.Now()
+
+	failover, ok := c.MembershipController.(FailoverController)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support failover", c.MembershipController)
+	}
+
+	cluster, err := failover.ClusterStatus(c.Node)
+	if err != nil {
+		return nil, err
+	}
+
+	// As with Promote, a master that can't be determined is what's being
+	// fixed, so an error is ignored.
+	previous, _ := c.Master()
+
+	to := options.To
+	if to == "" {
+		queues, err := failover.QueueStatus(c.Node)
+		if err != nil {
+			return nil, err
+		}
+
+		if to, err = failoverCandidate(cluster, queues, previous); err != nil {
+			return nil, err
+		}
+	} else if err := checkFailoverTarget(cluster, to); err != nil {
+		return nil, err
+	}
+
+	if to == previous {
+		r := c.newResult(OperationFailover, start)
+		r.Action = ActionNone
+		r.PreviousMaster = previous
+		r.Master = previous
+		return r, nil
+	}
+
+	if err := failover.SynchroniseQueues(to); err != nil {
+		return nil, err
+	}
+
+	// Clients that are already connected to the new master don't show
+	// that clients of the old master have reconnected, so the connections
+	// are counted just before the master is changed.
+	connections, err := failover.Connections(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SetMaster(to); err != nil {
+		return nil, err
+	}
+
+	err = failover.TransferLeadership(to)
+	if err == nil && connections[previous] > 0 {
+		timeout := options.ReconnectTimeout
+		if timeout == 0 {
+			timeout = DefaultReconnectTimeout
+		}
+		err = failover.WaitForConnections(to, connections[to], timeout)
+	}
+
+	r := c.newResult(OperationFailover, start)
+	r.Action = ActionFailedOver
+	r.PreviousMaster = previous
+	r.Master = to
+	r.Nodes = c.nodeStates()
+	return r, err
+}
+
+// failoverCandidate returns the best node to fail over to: a running, fully
+// synchronised node, other than the master, without alarms. Disc nodes are
+// preferred.
+func failoverCandidate(cluster *ClusterStatus, queues []QueueStatus, master string) (string, error) {
+	unsynchronised := make(map[string]int)
+	for _, q := range queues {
+		for _, node := range q.Unsynchronised {
+			unsynchronised[node]++
+		}
+	}
+
+	var candidates []string
+	for _, node := range cluster.Nodes() {
+		if node != master && checkFailoverTarget(cluster, node) == nil {
+			candidates = append(candidates, node)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", errNoFailoverCandidate
+	}
+
+	synchronised := candidates[:0]
+	for _, node := range candidates {
+		if unsynchronised[node] == 0 {
+			synchronised = append(synchronised, node)
+		}
+	}
+	candidates = synchronised
+
+	if len(candidates) == 0 {
+		return "", errNoSynchronisedCandidate
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if cluster.IsDisc(a) != cluster.IsDisc(b) {
+			return cluster.IsDisc(a)
+		}
+		return a < b
+	})
+
+	return candidates[0], nil
+}
+
+// checkFailoverTarget returns an error if the node can't be the master.
+func checkFailoverTarget(cluster *ClusterStatus, node string) error {
+	if !cluster.IsMember(node) {
+		return &FailoverTargetError{Node: node, Reason: "not a member of the cluster"}
+	}
+
+	if !cluster.IsRunning(node) {
+		return &FailoverTargetError{Node: node, Reason: "not running"}
+	}
+
+	for _, alarm := range cluster.Alarms {
+		if alarm.Node == node {
+			return &FailoverTargetError{Node: node, Reason: alarm.Resource + " alarm"}
+		}
+	}
+
+	return nil
+}
+
+// SynchroniseQueues synchronises all queues that have an unsynchronised mirror
+// on the node, and waits up to DefaultSyncTimeout for synchronisation to
+// complete.
+func (c *RabbitmqCtlMembershipController) SynchroniseQueues(node string) error {
+	return synchroniseQueues(c.rabbitmqctl, node, DefaultSyncTimeout, c.pollInterval, c.plan)
+}
+
+// TransferLeadership transfers the leadership of quorum queues that the node is
+// an online member of, but doesn't lead, to the node.
+func (c *RabbitmqCtlMembershipController) TransferLeadership(node string) error {
+	queues, err := listQueues(c.rabbitmqctl, node)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range queues {
+		if !q.Quorum() || q.Node == node || !contains(q.OnlineNodes, node) {
+			continue
+		}
+
+		out, err := c.rabbitmqctl(node, "eval", transferLeadershipExpr(q.VHost, q.Name, node))
+		if err != nil {
+			return err
+		}
+
+		// In dry run mode, the command isn't run, so there's no output.
+		if c.plan == nil && !strings.HasPrefix(strings.TrimSpace(out), "{migrated,") {
+			return fmt.Errorf("transferring leadership of queue %s in vhost %s to %s: %s", q.Name, q.VHost, node, strings.TrimSpace(out))
+		}
+	}
+
+	return nil
+}
+
+// transferLeadershipExpr returns an erlang expression that transfers the
+// leadership of a quorum queue to the node.
+func transferLeadershipExpr(vhost, name, node string) string {
+	return fmt.Sprintf(
+		"{ok, Q} = rabbit_amqqueue:lookup(rabbit_misc:r(%s, queue, %s)), rabbit_quorum_queue:transfer_leadership(Q, %s).",
+		erlangBinary(vhost), erlangBinary(name), erlangAtom(node),
+	)
+}
+
+var erlangEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `'`, `\'`)
+
+// erlangBinary returns an erlang utf8 binary literal.
+func erlangBinary(s string) string {
+	return `<<"` + erlangEscaper.Replace(s) + `"/utf8>>`
+}
+
+// erlangAtom returns a quoted erlang atom.
+func erlangAtom(s string) string {
+	return `'` + erlangEscaper.Replace(s) + `'`
+}
+
+// Connections returns the number of client connections to each node in the
+// cluster, as seen from the given node.
+func (c *RabbitmqCtlMembershipController) Connections(node string) (map[string]int, error) {
+	columns := []string{"pid"}
+
+	out, err := c.rabbitmqctl(node, "list_connections", append([]string{"-q"}, columns...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := make(map[string]int)
+	for _, fields := range parseTable(out, columns) {
+		connections[pidNode(fields[0])]++
+	}
+
+	return connections, nil
+}
+
+// WaitForConnections waits until more than baseline clients are connected to
+// the node. In dry run mode, it returns immediately, since clients won't move.
+func (c *RabbitmqCtlMembershipController) WaitForConnections(node string, baseline int, timeout time.Duration) error {
+	if c.plan != nil {
+		return nil
+	}
+
+	deadline := time.After(timeout)
+	for {
+		connections, err := c.Connections(node)
+		if err != nil {
+			return err
+		}
+
+		if connections[node] > baseline {
+			return nil
+		}
+
+		select {
+		case <-deadline:
+			return &ClientsNotReconnectedError{Node: node, Timeout: timeout}
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package clusterctl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController_Failover(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@c",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	queues := "events\t<rabbit@a.1.2.3>\t[<rabbit@b.1.2.3>, <rabbit@c.1.2.3>]\t[<rabbit@b.1.2.3>]\tclassic\t\t\n" +
+		"orders\t<rabbit@a.1.2.3>\t\t\tquorum\t[rabbit@a, rabbit@b, rabbit@c]\t[rabbit@a, rabbit@b, rabbit@c]\n"
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@c", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@a", "rabbit@b", "rabbit@c"), nil)
+	for _, node := range []string{"rabbit@b", "rabbit@c"} {
+		m.On("rabbitmqctl", node, "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+		m.On("rabbitmqctl", node, "list_queues", listQueuesArgs("/")).Return(queues, nil)
+	}
+	// A client is already connected to rabbit@b before the failover, so
+	// one of the clients of rabbit@a has to reconnect to it.
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("<rabbit@a.1.2.3>\n<rabbit@a.1.2.4>\n<rabbit@b.1.2.3>\n", nil).Once()
+	master.On("SetMaster", "rabbit@b").Return(nil)
+	m.On("rabbitmqctl", "rabbit@b", "eval", []string{transferLeadershipExpr("/", "orders", "rabbit@b")}).Return("{migrated,'rabbit@b'}\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("<rabbit@a.1.2.4>\n<rabbit@b.1.2.3>\n<rabbit@b.1.2.4>\n", nil)
+
+	r, err := c.Failover(FailoverOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, ActionFailedOver, r.Action)
+	assert.Equal(t, "rabbit@a", r.PreviousMaster)
+	assert.Equal(t, "rabbit@b", r.Master)
+	assert.Len(t, r.Nodes, 3)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestController_Failover_NotReconnected(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@a",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@a", "rabbit@b"), nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return("", nil)
+	master.On("SetMaster", "rabbit@b").Return(nil)
+
+	// The client that was already connected to rabbit@b doesn't count as
+	// a reconnection.
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("<rabbit@a.1.2.3>\n<rabbit@b.1.2.3>\n", nil)
+
+	r, err := c.Failover(FailoverOptions{To: "rabbit@b", ReconnectTimeout: time.Millisecond})
+	assert.Equal(t, &ClientsNotReconnectedError{Node: "rabbit@b", Timeout: time.Millisecond}, err)
+	assert.Equal(t, "rabbit@b", r.Master)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestController_Failover_SetMasterFailed(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@a",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	queues := "orders\t<rabbit@a.1.2.3>\t\t\tquorum\t[rabbit@a, rabbit@b]\t[rabbit@a, rabbit@b]\n"
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@a", "rabbit@b"), nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return(queues, nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("<rabbit@a.1.2.3>\n", nil)
+	master.On("SetMaster", "rabbit@b").Return(errMasterLocked)
+
+	// The leadership of the quorum queue isn't transferred to rabbit@b,
+	// since it didn't become the master.
+	r, err := c.Failover(FailoverOptions{To: "rabbit@b"})
+	assert.Equal(t, errMasterLocked, err)
+	assert.Nil(t, r)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestController_Failover_InvalidTarget(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@a",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@a", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@a", "rabbit@b"), nil)
+
+	_, err := c.Failover(FailoverOptions{To: "rabbit@other"})
+	assert.Equal(t, &FailoverTargetError{Node: "rabbit@other", Reason: "not a member of the cluster"}, err)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestFailoverCandidate(t *testing.T) {
+	tests := []struct {
+		cluster   *ClusterStatus
+		queues    []QueueStatus
+		candidate string
+		err       error
+	}{
+		// Only picks fully synchronised nodes.
+		{
+			&ClusterStatus{DiscNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c"}, RunningNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c"}},
+			[]QueueStatus{{Name: "events", Node: "rabbit@a", Unsynchronised: []string{"rabbit@b"}}},
+			"rabbit@c",
+			nil,
+		},
+
+		// Prefers disc nodes.
+		{
+			&ClusterStatus{DiscNodes: []string{"rabbit@a", "rabbit@c"}, RAMNodes: []string{"rabbit@b"}, RunningNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c"}},
+			nil,
+			"rabbit@c",
+			nil,
+		},
+
+		// Skips nodes that are stopped or have alarms.
+		{
+			&ClusterStatus{DiscNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c", "rabbit@d"}, RunningNodes: []string{"rabbit@a", "rabbit@c", "rabbit@d"}, Alarms: []Alarm{{Node: "rabbit@c", Resource: "disk"}}},
+			nil,
+			"rabbit@d",
+			nil,
+		},
+
+		// No fully synchronised candidates.
+		{
+			&ClusterStatus{DiscNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c"}, RunningNodes: []string{"rabbit@a", "rabbit@b", "rabbit@c"}},
+			[]QueueStatus{{Name: "events", Node: "rabbit@a", Unsynchronised: []string{"rabbit@b", "rabbit@c"}}},
+			"",
+			errNoSynchronisedCandidate,
+		},
+
+		// No candidates.
+		{
+			&ClusterStatus{DiscNodes: []string{"rabbit@a", "rabbit@b"}, RunningNodes: []string{"rabbit@a"}},
+			nil,
+			"",
+			errNoFailoverCandidate,
+		},
+	}
+
+	for _, tt := range tests {
+		candidate, err := failoverCandidate(tt.cluster, tt.queues, "rabbit@a")
+		assert.Equal(t, tt.err, err)
+		assert.Equal(t, tt.candidate, candidate)
+	}
+}
+
+func TestTransferLeadershipExpr(t *testing.T) {
+	assert.Equal(t,
+		`{ok, Q} = rabbit_amqqueue:lookup(rabbit_misc:r(<<"/"/utf8>>, queue, <<"a \"b\""/utf8>>)), rabbit_quorum_queue:transfer_leadership(Q, 'rabbit@b').`,
+		transferLeadershipExpr("/", `a "b"`, "rabbit@b"),
+	)
+}
@@ -0,0 +1,183 @@
+package clusterctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	// file:///path/to/master
+	RegisterMaster("file", func(u *MasterURL) (MasterController, error) {
+		return NewFileMasterController(u.Target), nil
+	})
+
+	newHTTP := func(u *MasterURL) (MasterController, error) {
+		return NewHTTPMasterController(u.URL()), nil
+	}
+	RegisterMaster("http", newHTTP)
+	RegisterMaster("https", newHTTP)
+}
+
+var errReadOnly = errors.New("master is read only and cannot be changed")
+
+// FileMasterController implements the MasterController interface using a file
+// as the source of truth. The file contains either the node name of the master
+// as plain text, or a JSON object of the form {"master": "rabbit@host"}.
+//
+// SetMaster writes the file atomically by renaming a temporary file into
+// place, while holding a lock on a lock file (Path + ".lock") so that
+// concurrent changes fail rather than the last writer winning. See lockFile
+// for how the lock is held on each platform.
+type FileMasterController struct {
+	// The path to the file.
+	Path string
+}
+
+// NewFileMasterController returns a new FileMasterController that stores the
+// master in the file at path.
+func NewFileMasterController(path string) *FileMasterController {
+	return &FileMasterController{Path: path}
+}
+
+// masterDocument is the JSON representation of the master.
+type masterDocument struct {
+	Master string `json:"master"`
+}
+
+// Master returns the node name of the current master.
+func (c *FileMasterController) Master() (string, error) {
+	raw, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errNoMaster
+		}
+		return "", err
+	}
+
+	return parseMaster(raw)
+}
+
+// SetMaster sets the node to be the new master. The file is written in the
+// same format that it's currently in, defaulting to plain text.
+func (c *FileMasterController) SetMaster(node string) error {
+	unlock, err := lockFile(c.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	raw := []byte(node + "\n")
+	if existing, err := ioutil.ReadFile(c.Path); err == nil && isJSON(existing) {
+		raw, err = json.Marshal(masterDocument{Master: node})
+		if err != nil {
+			return err
+		}
+		raw = append(raw, '\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.Path), "."+filepath.Base(c.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.Path)
+}
+
+// HTTPMasterController is a read only MasterController that fetches the master
+// from a URL. The response body is either the node name of the master as plain
+// text, or a JSON object of the form {"master": "rabbit@host"}.
+type HTTPMasterController struct {
+	// The URL to fetch the master from.
+	URL string
+
+	client *http.Client
+}
+
+// NewHTTPMasterController returns a new HTTPMasterController that fetches the
+// master from url.
+func NewHTTPMasterController(url string) *HTTPMasterController {
+	return &HTTPMasterController{
+		URL:    url,
+		client: httpClient,
+	}
+}
+
+// Master returns the node name of the current master.
+func (c *HTTPMasterController) Master() (string, error) {
+	resp, err := c.client.Get(c.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errNoMaster
+	default:
+		return "", fmt.Errorf("http: GET %s: %s: %s", c.URL, resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	return parseMaster(raw)
+}
+
+// SetMaster always returns an error, since the master is managed elsewhere.
+func (c *HTTPMasterController) SetMaster(node string) error {
+	return errReadOnly
+}
+
+// parseMaster parses the node name of the master from either plain text or a
+// JSON document.
+func parseMaster(raw []byte) (string, error) {
+	var node string
+	if isJSON(raw) {
+		var doc masterDocument
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return "", err
+		}
+		node = doc.Master
+	} else {
+		node = string(raw)
+	}
+
+	node = strings.TrimSpace(node)
+	if node == "" {
+		return "", errNoMaster
+	}
+
+	return node, nil
+}
+
+func isJSON(raw []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(raw)), "{")
+}
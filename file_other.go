@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package clusterctl
+
+import "os"
+
+// lockFile creates the file at path, failing with errMasterLocked if it already
+// exists, and returns a function that removes it. flock isn't available on
+// this platform, so a process that crashes while holding the lock leaves the
+// file behind, and it has to be removed by hand.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errMasterLocked
+		}
+		return nil, err
+	}
+	f.Close()
+
+	return func() { os.Remove(path) }, nil
+}
@@ -0,0 +1,111 @@
+package clusterctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMasterController_Master(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := NewFileMasterController(filepath.Join(dir, "master"))
+
+	_, err := c.Master()
+	assert.Equal(t, errNoMaster, err)
+
+	tests := []struct {
+		contents string
+		node     string
+	}{
+		{"rabbit@master\n", "rabbit@master"},
+		{`{"master": "rabbit@master"}`, "rabbit@master"},
+	}
+
+	for _, tt := range tests {
+		assert.NoError(t, ioutil.WriteFile(c.Path, []byte(tt.contents), 0644))
+
+		node, err := c.Master()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.node, node)
+	}
+}
+
+func TestFileMasterController_SetMaster(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := NewFileMasterController(filepath.Join(dir, "master"))
+
+	err := c.SetMaster("rabbit@master")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@master\n", readFile(t, c.Path))
+
+	// JSON files should stay JSON.
+	assert.NoError(t, ioutil.WriteFile(c.Path, []byte(`{"master": "rabbit@master"}`), 0644))
+
+	err = c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"master\":\"rabbit@slave\"}\n", readFile(t, c.Path))
+
+	// No temporary files should be left behind.
+	tmp, _ := filepath.Glob(filepath.Join(dir, ".master*"))
+	assert.Empty(t, tmp)
+}
+
+func TestHTTPMasterController_Master(t *testing.T) {
+	body := "rabbit@master\n"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer s.Close()
+
+	c := NewHTTPMasterController(s.URL)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@master", node)
+
+	body = `{"master": "rabbit@slave"}`
+	node, err = c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave", node)
+
+	body = ""
+	_, err = c.Master()
+	assert.Equal(t, errNoMaster, err)
+}
+
+func TestHTTPMasterController_SetMaster(t *testing.T) {
+	c := NewHTTPMasterController("http://localhost/master")
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, errReadOnly, err)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "clusterctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readFile(t *testing.T, path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
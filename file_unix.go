@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package clusterctl
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file at path, creating it if it
+// doesn't exist, and returns a function that releases it. errMasterLocked is
+// returned if another process holds the lock. The file is left in place, but
+// the lock is released by the kernel when the process exits, so a crash
+// doesn't leave it locked.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errMasterLocked
+		}
+		return nil, err
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
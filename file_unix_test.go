@@ -0,0 +1,52 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package clusterctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMasterController_SetMaster_Locked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := NewFileMasterController(filepath.Join(dir, "master"))
+
+	// Simulate another process holding the lock.
+	f, err := os.Create(c.Path + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.NoError(t, syscall.Flock(int(f.Fd()), syscall.LOCK_EX))
+
+	err = c.SetMaster("rabbit@slave")
+	assert.Equal(t, errMasterLocked, err)
+
+	_, err = c.Master()
+	assert.Equal(t, errNoMaster, err)
+}
+
+func TestFileMasterController_SetMaster_StaleLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A lock file left behind by a process that exited isn't locked.
+	c := NewFileMasterController(filepath.Join(dir, "master"))
+	assert.NoError(t, ioutil.WriteFile(c.Path+".lock", nil, 0644))
+
+	err := c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@slave\n", readFile(t, c.Path))
+
+	// The lock file is kept.
+	_, err = os.Stat(c.Path + ".lock")
+	assert.NoError(t, err)
+}
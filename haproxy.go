@@ -0,0 +1,324 @@
+package clusterctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// The columns of `show servers state` that we use.
+const (
+	haproxyColumnBackend    = "be_name"
+	haproxyColumnName       = "srv_name"
+	haproxyColumnAddr       = "srv_addr"
+	haproxyColumnAdminState = "srv_admin_state"
+	haproxyColumnFQDN       = "srv_fqdn"
+)
+
+func init() {
+	// haproxy:///var/run/haproxy.sock?backend=rabbitmq, or
+	// haproxy://host:port?backend=rabbitmq for a TCP socket.
+	RegisterMaster("haproxy", func(u *MasterURL) (MasterController, error) {
+		backend := u.Get("backend")
+		if backend == "" {
+			return nil, errors.New("haproxy: backend is required")
+		}
+		return NewHAProxyMasterController(u.Target, backend), nil
+	})
+}
+
+var errNoServer = errors.New("no haproxy server found for node")
+
+// HAProxyMasterController implements the MasterController interface using an
+// HAProxy backend as the source of truth. The master is the single server in
+// the backend that is not in maintenance (or drain) mode. It talks to HAProxy
+// using the runtime API on the stats socket.
+type HAProxyMasterController struct {
+	// The address of the HAProxy stats socket. Paths are treated as unix
+	// sockets, anything else as a TCP address.
+	Socket string
+
+	// The name of the backend that contains the rabbitmq servers.
+	Backend string
+
+	// The maximum amount of time that a single runtime API command can
+	// take.
+	Timeout time.Duration
+
+	lookupAddr func(addr string) ([]string, error)
+	lookupHost func(host string) ([]string, error)
+}
+
+// NewHAProxyMasterController returns a new HAProxyMasterController for the
+// backend, using the stats socket at socket.
+func NewHAProxyMasterController(socket, backend string) *HAProxyMasterController {
+	return &HAProxyMasterController{
+		Socket:     socket,
+		Backend:    backend,
+		Timeout:    10 * time.Second,
+		lookupAddr: net.LookupAddr,
+		lookupHost: net.LookupHost,
+	}
+}
+
+// haproxyServer is a single server from `show servers state`.
+type haproxyServer struct {
+	Name       string
+	Addr       string
+	FQDN       string
+	AdminState int
+}
+
+// Active returns true if the server is not in maintenance or drain mode.
+func (s *haproxyServer) Active() bool {
+	return s.AdminState == 0
+}
+
+// Master returns the node name of the current master.
+func (c *HAProxyMasterController) Master() (string, error) {
+	server, err := c.Server()
+	if err != nil {
+		return "", err
+	}
+
+	hostname, err := c.hostname(server)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("rabbit@%s", hostname), nil
+}
+
+// Server returns the server that is the current master.
+func (c *HAProxyMasterController) Server() (*haproxyServer, error) {
+	servers, err := c.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	var active []*haproxyServer
+	for _, s := range servers {
+		if s.Active() {
+			active = append(active, s)
+		}
+	}
+
+	// There should always be 1 active server in the backend.
+	if len(active) == 0 {
+		return nil, errNoInstances
+	}
+
+	// There should be AT MOST 1 active server in the backend.
+	if len(active) > 1 {
+		return nil, errTooManyInstances
+	}
+
+	return active[0], nil
+}
+
+// SetMaster sets the node to be the new master. The server for the node is made
+// ready before the other servers are put into maintenance, so there's no window
+// where no servers are active.
+func (c *HAProxyMasterController) SetMaster(node string) error {
+	servers, err := c.servers()
+	if err != nil {
+		return err
+	}
+
+	server, err := c.serverForNode(servers, node)
+	if err != nil {
+		return err
+	}
+
+	if err := c.setState(server, "ready"); err != nil {
+		return err
+	}
+
+	for _, s := range servers {
+		if s == server || s.AdminState&haproxyAdminForcedMaint != 0 {
+			continue
+		}
+
+		if err := c.setState(s, "maint"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The admin state flag that is set when a server is put into maintenance with
+// `set server ... state maint`.
+const haproxyAdminForcedMaint = 0x01
+
+// serverForNode returns the server that the node is running on, matching on
+// the server's FQDN or address.
+func (c *HAProxyMasterController) serverForNode(servers []*haproxyServer, node string) (*haproxyServer, error) {
+	hostname, err := nodeHost(node)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range servers {
+		if s.FQDN == hostname || s.Addr == hostname {
+			return s, nil
+		}
+	}
+
+	addrs, err := c.lookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range servers {
+		for _, addr := range addrs {
+			if s.Addr == addr {
+				return s, nil
+			}
+		}
+	}
+
+	return nil, errNoServer
+}
+
+// hostname returns the hostname of the server, using the FQDN if it has one,
+// otherwise the reverse DNS name of its address.
+func (c *HAProxyMasterController) hostname(s *haproxyServer) (string, error) {
+	if s.FQDN != "" {
+		return s.FQDN, nil
+	}
+
+	if net.ParseIP(s.Addr) == nil {
+		return s.Addr, nil
+	}
+
+	names, err := c.lookupAddr(s.Addr)
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("haproxy: no hostname found for server %s (%s)", s.Name, s.Addr)
+	}
+
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+// servers returns the servers in the backend.
+func (c *HAProxyMasterController) servers() ([]*haproxyServer, error) {
+	out, err := c.command("show servers state " + c.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseServersState(out, c.Backend)
+}
+
+// setState changes the admin state of the server.
+func (c *HAProxyMasterController) setState(s *haproxyServer, state string) error {
+	out, err := c.command(fmt.Sprintf("set server %s/%s state %s", c.Backend, s.Name, state))
+	if err != nil {
+		return err
+	}
+
+	// Successful commands don't output anything.
+	if out := strings.TrimSpace(out); out != "" {
+		return fmt.Errorf("haproxy: set server %s/%s state %s: %s", c.Backend, s.Name, state, out)
+	}
+
+	return nil
+}
+
+// command runs a single command against the runtime API, returning the output.
+func (c *HAProxyMasterController) command(cmd string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.Socket, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, c.Socket, c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if c.Timeout != 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+		return "", err
+	}
+
+	// In non-interactive mode, HAProxy closes the connection after
+	// responding.
+	raw, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
+}
+
+// parseServersState parses the output of `show servers state`. The first line
+// is the format version, followed by a header line starting with "#" that names
+// the columns.
+func parseServersState(out, backend string) ([]*haproxyServer, error) {
+	var (
+		columns map[string]int
+		servers []*haproxyServer
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			columns = make(map[string]int)
+			for i, name := range strings.Fields(strings.TrimPrefix(line, "#")) {
+				columns[name] = i
+			}
+			continue
+		}
+
+		// The format version, or an error message before the header.
+		if columns == nil {
+			if _, err := fmt.Sscanf(line, "%d", new(int)); err != nil {
+				return nil, fmt.Errorf("haproxy: %s", line)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(fields) || fields[i] == "-" {
+				return ""
+			}
+			return fields[i]
+		}
+
+		if field(haproxyColumnBackend) != backend {
+			continue
+		}
+
+		var adminState int
+		fmt.Sscanf(field(haproxyColumnAdminState), "%d", &adminState)
+
+		servers = append(servers, &haproxyServer{
+			Name:       field(haproxyColumnName),
+			Addr:       field(haproxyColumnAddr),
+			FQDN:       field(haproxyColumnFQDN),
+			AdminState: adminState,
+		})
+	}
+
+	return servers, scanner.Err()
+}
@@ -0,0 +1,218 @@
+package clusterctl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHAProxyMasterController_Master(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "", 0)
+	haproxy.add("rabbit2", "10.0.0.2", "", haproxyAdminForcedMaint)
+
+	c := haproxy.controller()
+	c.lookupAddr = func(addr string) ([]string, error) {
+		assert.Equal(t, "10.0.0.1", addr)
+		return []string{"ip-10-0-0-1.ec2.internal."}, nil
+	}
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-10-0-0-1.ec2.internal", node)
+}
+
+func TestHAProxyMasterController_Master_FQDN(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "rabbit1.example.com", haproxyAdminForcedMaint)
+	haproxy.add("rabbit2", "10.0.0.2", "rabbit2.example.com", 0)
+
+	node, err := haproxy.controller().Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@rabbit2.example.com", node)
+}
+
+func TestHAProxyMasterController_Master_NoInstances(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "", haproxyAdminForcedMaint)
+
+	_, err := haproxy.controller().Master()
+	assert.Equal(t, errNoInstances, err)
+}
+
+func TestHAProxyMasterController_Master_TooManyInstances(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "", 0)
+	haproxy.add("rabbit2", "10.0.0.2", "", 0)
+
+	_, err := haproxy.controller().Master()
+	assert.Equal(t, errTooManyInstances, err)
+}
+
+func TestHAProxyMasterController_Master_NoBackend(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	c := haproxy.controller()
+	c.Backend = "other"
+
+	_, err := c.Master()
+	assert.EqualError(t, err, "haproxy: Can't find backend.")
+}
+
+func TestHAProxyMasterController_SetMaster(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "", 0)
+	haproxy.add("rabbit2", "10.0.0.2", "", haproxyAdminForcedMaint)
+	haproxy.add("rabbit3", "10.0.0.3", "", haproxyAdminForcedMaint)
+
+	c := haproxy.controller()
+	c.lookupHost = func(host string) ([]string, error) {
+		assert.Equal(t, "ip-10-0-0-2.ec2.internal", host)
+		return []string{"10.0.0.2"}, nil
+	}
+
+	err := c.SetMaster("rabbit@ip-10-0-0-2.ec2.internal")
+	assert.NoError(t, err)
+
+	// The new master should be made ready before the old master is put
+	// into maintenance.
+	assert.Equal(t, []string{
+		"set server rabbitmq/rabbit2 state ready",
+		"set server rabbitmq/rabbit1 state maint",
+	}, haproxy.changes)
+}
+
+func TestHAProxyMasterController_SetMaster_NoServer(t *testing.T) {
+	haproxy := newFakeHAProxy(t)
+	defer haproxy.Close()
+
+	haproxy.add("rabbit1", "10.0.0.1", "", 0)
+
+	c := haproxy.controller()
+	c.lookupHost = func(host string) ([]string, error) {
+		return []string{"10.0.0.9"}, nil
+	}
+
+	err := c.SetMaster("rabbit@ip-10-0-0-9.ec2.internal")
+	assert.Equal(t, errNoServer, err)
+	assert.Equal(t, 0, len(haproxy.changes))
+}
+
+// fakeHAProxy is a fake HAProxy runtime API listening on a unix socket.
+type fakeHAProxy struct {
+	sync.Mutex
+	net.Listener
+
+	dir     string
+	servers []*haproxyServer
+	changes []string
+}
+
+func newFakeHAProxy(t *testing.T) *fakeHAProxy {
+	dir := tempDir(t)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "haproxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeHAProxy{Listener: l, dir: dir}
+	go f.serve()
+	return f
+}
+
+func (f *fakeHAProxy) Close() error {
+	defer os.RemoveAll(f.dir)
+	return f.Listener.Close()
+}
+
+func (f *fakeHAProxy) controller() *HAProxyMasterController {
+	return NewHAProxyMasterController(f.Addr().String(), "rabbitmq")
+}
+
+func (f *fakeHAProxy) add(name, addr, fqdn string, adminState int) {
+	f.Lock()
+	defer f.Unlock()
+	f.servers = append(f.servers, &haproxyServer{Name: name, Addr: addr, FQDN: fqdn, AdminState: adminState})
+}
+
+func (f *fakeHAProxy) serve() {
+	for {
+		conn, err := f.Accept()
+		if err != nil {
+			return
+		}
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, f.handle(strings.TrimSpace(line)))
+		conn.Close()
+	}
+}
+
+func (f *fakeHAProxy) handle(cmd string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	var backend, server, state string
+	switch {
+	case strings.HasPrefix(cmd, "show servers state "):
+		if strings.TrimPrefix(cmd, "show servers state ") != "rabbitmq" {
+			return "Can't find backend.\n"
+		}
+
+		out := "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n"
+		for i, s := range f.servers {
+			fqdn := s.FQDN
+			if fqdn == "" {
+				fqdn = "-"
+			}
+			out += fmt.Sprintf("3 rabbitmq %d %s %s 2 %d 1 1 100 6 3 4 6 0 0 0 %s 5672 -\n", i+1, s.Name, s.Addr, s.AdminState, fqdn)
+		}
+		return out + "\n"
+	case sscan(cmd, "set server %s state %s", &server, &state) == 2:
+		parts := strings.SplitN(server, "/", 2)
+		backend, server = parts[0], parts[1]
+		if backend != "rabbitmq" {
+			return "No such backend.\n"
+		}
+		for _, s := range f.servers {
+			if s.Name != server {
+				continue
+			}
+			switch state {
+			case "ready":
+				s.AdminState = 0
+			case "maint":
+				s.AdminState |= haproxyAdminForcedMaint
+			}
+			f.changes = append(f.changes, cmd)
+			return "\n"
+		}
+		return "No such server.\n"
+	default:
+		return "Unknown command.\n"
+	}
+}
+
+func sscan(s, format string, a ...interface{}) int {
+	n, _ := fmt.Sscanf(s, format, a...)
+	return n
+}
@@ -0,0 +1,435 @@
+package clusterctl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultSelectorLabel is the pod label that the master service selects on by
+// default. It's set by the StatefulSet controller on every pod.
+const DefaultSelectorLabel = "statefulset.kubernetes.io/pod-name"
+
+// Paths to the service account credentials that are mounted into every pod.
+const (
+	serviceAccountToken  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCACert = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// The format of a metav1.MicroTime.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+func init() {
+	// kubernetes://<namespace>/<lease>?service=<service>, using the pod's
+	// service account.
+	RegisterMaster("kubernetes", func(u *MasterURL) (MasterController, error) {
+		namespace := u.Host()
+		if namespace == "" {
+			namespace = "default"
+		}
+
+		m, err := NewInClusterKubernetesMasterController(namespace, u.Path(), u.Get("service"))
+		if err != nil {
+			return nil, err
+		}
+
+		if label := u.Get("selector_label"); label != "" {
+			m.SelectorLabel = label
+		}
+
+		return m, nil
+	})
+}
+
+var errNotInCluster = errors.New("not running inside a kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+
+// KubernetesMasterController implements the MasterController interface for
+// rabbitmq running on kubernetes. The master node is recorded in a
+// coordination.k8s.io/v1 Lease, and the selector of a Service is updated so
+// that clients of the service follow the master.
+type KubernetesMasterController struct {
+	// The URL of the kubernetes API server.
+	Host string
+
+	// The namespace that the Lease and Service live in.
+	Namespace string
+
+	// The name of the Lease that records the master.
+	LeaseName string
+
+	// The name of the Service that should point at the master. If empty,
+	// no service is updated.
+	ServiceName string
+
+	// The pod label that the Service selects the master with. The default
+	// is DefaultSelectorLabel.
+	SelectorLabel string
+
+	// The bearer token used to authenticate with the API server.
+	Token string
+
+	client *http.Client
+}
+
+// NewKubernetesMasterController returns a new KubernetesMasterController that
+// talks to the API server at host.
+func NewKubernetesMasterController(host, namespace, leaseName, serviceName string) *KubernetesMasterController {
+	return &KubernetesMasterController{
+		Host:          strings.TrimSuffix(host, "/"),
+		Namespace:     namespace,
+		LeaseName:     leaseName,
+		ServiceName:   serviceName,
+		SelectorLabel: DefaultSelectorLabel,
+		client:        httpClient,
+	}
+}
+
+// NewInClusterKubernetesMasterController returns a new
+// KubernetesMasterController that uses the service account credentials of the
+// pod that it's running in.
+func NewInClusterKubernetesMasterController(namespace, leaseName, serviceName string) (*KubernetesMasterController, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errNotInCluster
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountCACert)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubernetes: no certificates found in %s", serviceAccountCACert)
+	}
+
+	c := NewKubernetesMasterController("https://"+net.JoinHostPort(host, port), namespace, leaseName, serviceName)
+	c.Token = strings.TrimSpace(string(token))
+	c.client = &http.Client{
+		Timeout: DefaultHTTPTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	return c, nil
+}
+
+// kubernetesLease is the subset of a coordination.k8s.io/v1 Lease that we use.
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       *string `json:"holderIdentity,omitempty"`
+		AcquireTime          *string `json:"acquireTime,omitempty"`
+		RenewTime            *string `json:"renewTime,omitempty"`
+		LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+		LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	} `json:"spec"`
+}
+
+// Master returns the node name of the current master.
+func (c *KubernetesMasterController) Master() (string, error) {
+	lease, err := c.lease()
+	if err != nil {
+		return "", err
+	}
+
+	if lease == nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return "", errNoMaster
+	}
+
+	return *lease.Spec.HolderIdentity, nil
+}
+
+// SetMaster records the node as the new master in the Lease, then updates the
+// Service to select the pod that the node is running in. If the Service can't
+// be updated, the Lease is restored to the previous master and a
+// *KubernetesServiceError is returned.
+func (c *KubernetesMasterController) SetMaster(node string) error {
+	pod, err := podName(node)
+	if err != nil {
+		return err
+	}
+
+	lease, err := c.lease()
+	if err != nil {
+		return err
+	}
+
+	if lease == nil {
+		lease = &kubernetesLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+		}
+		lease.Metadata.Name = c.LeaseName
+		lease.Metadata.Namespace = c.Namespace
+	}
+
+	previous := lease.Spec
+	now := time.Now().UTC().Format(microTimeFormat)
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != node {
+		transitions := 0
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &node
+	lease.Spec.RenewTime = &now
+
+	updated, err := c.updateLease(lease)
+	if err != nil {
+		return err
+	}
+
+	if c.ServiceName == "" {
+		return nil
+	}
+
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"selector": map[string]string{
+				c.selectorLabel(): pod,
+			},
+		},
+	}
+
+	if err := c.do("PATCH", c.servicePath(), "application/merge-patch+json", patch, nil); err != nil {
+		serviceErr := &KubernetesServiceError{
+			Node:    node,
+			Service: c.ServiceName,
+			Err:     err,
+		}
+
+		// Put the lease back, so that it doesn't disagree with the
+		// service about who the master is.
+		restore := *updated
+		restore.Spec = previous
+		if _, err := c.patchLease(&restore, true); err != nil {
+			serviceErr.RestoreErr = err
+		}
+
+		return serviceErr
+	}
+
+	return nil
+}
+
+// updateLease creates the lease if it doesn't have a resourceVersion, or
+// patches its spec otherwise, returning the updated lease. The resourceVersion
+// makes the update conditional, so concurrent changes to the master result in
+// a conflict rather than the last writer winning.
+func (c *KubernetesMasterController) updateLease(lease *kubernetesLease) (*kubernetesLease, error) {
+	var (
+		updated *kubernetesLease
+		err     error
+	)
+
+	if lease.Metadata.ResourceVersion == "" {
+		updated = new(kubernetesLease)
+		err = c.do("POST", c.leasesPath(), "application/json", lease, updated)
+	} else {
+		updated, err = c.patchLease(lease, false)
+	}
+
+	if err, ok := err.(*kubernetesError); ok && err.StatusCode == http.StatusConflict {
+		return nil, errMasterConflict
+	}
+
+	return updated, err
+}
+
+// patchLease updates the spec of the lease with a JSON merge patch, so that
+// fields we don't know about are left alone. When clear is true, spec fields
+// that aren't set are removed from the lease.
+func (c *KubernetesMasterController) patchLease(lease *kubernetesLease, clear bool) (*kubernetesLease, error) {
+	// A null in a merge patch removes the field.
+	spec := map[string]interface{}{}
+	if lease.Spec.HolderIdentity != nil || clear {
+		spec["holderIdentity"] = lease.Spec.HolderIdentity
+	}
+	if lease.Spec.AcquireTime != nil || clear {
+		spec["acquireTime"] = lease.Spec.AcquireTime
+	}
+	if lease.Spec.RenewTime != nil || clear {
+		spec["renewTime"] = lease.Spec.RenewTime
+	}
+	if lease.Spec.LeaseTransitions != nil || clear {
+		spec["leaseTransitions"] = lease.Spec.LeaseTransitions
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": lease.Metadata.ResourceVersion,
+		},
+		"spec": spec,
+	}
+
+	var updated kubernetesLease
+	if err := c.do("PATCH", c.leasePath(), "application/merge-patch+json", patch, &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// KubernetesServiceError is returned by SetMaster when the Lease was updated,
+// but the Service could not be updated to select the new master.
+type KubernetesServiceError struct {
+	// The node that the Lease was updated to.
+	Node string
+
+	// The Service that could not be updated.
+	Service string
+
+	// The error from updating the Service.
+	Err error
+
+	// The error from restoring the Lease to the previous master. If this
+	// is not nil, the Lease names Node as the master, but the Service still
+	// selects the previous master.
+	RestoreErr error
+}
+
+// Error implements the error interface.
+func (e *KubernetesServiceError) Error() string {
+	msg := fmt.Sprintf("kubernetes: updating service %s to select %s failed: %v", e.Service, e.Node, e.Err)
+
+	if e.RestoreErr != nil {
+		return fmt.Sprintf("%s; restoring the lease failed, so the lease names %s but the service selects the previous master: %v", msg, e.Node, e.RestoreErr)
+	}
+
+	return fmt.Sprintf("%s; the lease was restored to the previous master", msg)
+}
+
+// Unwrap returns the error from updating the Service.
+func (e *KubernetesServiceError) Unwrap() error {
+	return e.Err
+}
+
+// lease returns the Lease, or nil if it doesn't exist.
+func (c *KubernetesMasterController) lease() (*kubernetesLease, error) {
+	var lease kubernetesLease
+	if err := c.do("GET", c.leasePath(), "", nil, &lease); err != nil {
+		if err, ok := err.(*kubernetesError); ok && err.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+func (c *KubernetesMasterController) leasesPath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", c.Namespace)
+}
+
+func (c *KubernetesMasterController) leasePath() string {
+	return c.leasesPath() + "/" + c.LeaseName
+}
+
+func (c *KubernetesMasterController) servicePath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/services/%s", c.Namespace, c.ServiceName)
+}
+
+func (c *KubernetesMasterController) selectorLabel() string {
+	if c.SelectorLabel == "" {
+		return DefaultSelectorLabel
+	}
+	return c.SelectorLabel
+}
+
+// kubernetesError is returned when the API server responds with an error.
+type kubernetesError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error implements the error interface.
+func (e *kubernetesError) Error() string {
+	return fmt.Sprintf("kubernetes: %d: %s", e.StatusCode, e.Message)
+}
+
+// do performs a request against the API server, encoding body and decoding
+// the response into v as json.
+func (c *KubernetesMasterController) do(method, path, contentType string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, c.Host+path, r)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		raw, _ := ioutil.ReadAll(resp.Body)
+		if err := json.Unmarshal(raw, &status); err != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(raw))
+		}
+		return &kubernetesError{StatusCode: resp.StatusCode, Message: status.Message}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// podName returns the name of the pod that a rabbitmq node is running in. Pods
+// in a StatefulSet have a stable DNS name of the form
+// <pod>.<service>.<namespace>.svc.cluster.local, so the pod name is the first
+// label of the node's hostname.
+func podName(node string) (string, error) {
+	hostname, err := nodeHost(node)
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(hostname, ".", 2)[0], nil
+}
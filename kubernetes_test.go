@@ -0,0 +1,326 @@
+package clusterctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubernetesMasterController_Master(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	c := newTestKubernetesMasterController(s.URL)
+
+	_, err := c.Master()
+	assert.Equal(t, errNoMaster, err)
+
+	err = c.SetMaster("rabbit@rabbitmq-0.rabbitmq-headless.default.svc.cluster.local")
+	assert.NoError(t, err)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@rabbitmq-0.rabbitmq-headless.default.svc.cluster.local", node)
+}
+
+func TestKubernetesMasterController_SetMaster(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	c := newTestKubernetesMasterController(s.URL)
+
+	err := c.SetMaster("rabbit@rabbitmq-0.rabbitmq-headless.default.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbitmq-0", k8s.selector[DefaultSelectorLabel])
+
+	err = c.SetMaster("rabbit@rabbitmq-1.rabbitmq-headless.default.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbitmq-1", k8s.selector[DefaultSelectorLabel])
+	assert.Equal(t, "app", k8s.selector["app"], "other selector labels should be preserved")
+
+	lease := k8s.decodedLease()
+	assert.Equal(t, "rabbit@rabbitmq-1.rabbitmq-headless.default.svc.cluster.local", *lease.Spec.HolderIdentity)
+	assert.Equal(t, 1, *lease.Spec.LeaseTransitions)
+	assert.NotNil(t, lease.Spec.AcquireTime)
+}
+
+func TestKubernetesMasterController_SetMaster_Conflict(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	c := newTestKubernetesMasterController(s.URL)
+
+	err := c.SetMaster("rabbit@rabbitmq-0.rabbitmq-headless")
+	assert.NoError(t, err)
+
+	// Simulate another process updating the lease between our read and
+	// write.
+	k8s.beforeUpdate = func() {
+		k8s.resourceVersion++
+	}
+
+	err = c.SetMaster("rabbit@rabbitmq-1.rabbitmq-headless")
+	assert.Equal(t, errMasterConflict, err)
+	assert.Equal(t, "rabbitmq-0", k8s.selector[DefaultSelectorLabel])
+}
+
+func TestKubernetesMasterController_SetMaster_PreservesFields(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	k8s.save(map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata": map[string]interface{}{
+			"name":   "rabbitmq-master",
+			"labels": map[string]interface{}{"app": "rabbitmq"},
+		},
+		"spec": map[string]interface{}{
+			"holderIdentity":  "rabbit@rabbitmq-0.rabbitmq-headless",
+			"preferredHolder": "rabbit@rabbitmq-2.rabbitmq-headless",
+		},
+	})
+
+	c := newTestKubernetesMasterController(s.URL)
+
+	err := c.SetMaster("rabbit@rabbitmq-1.rabbitmq-headless")
+	assert.NoError(t, err)
+
+	spec := k8s.lease["spec"].(map[string]interface{})
+	assert.Equal(t, "rabbit@rabbitmq-1.rabbitmq-headless", spec["holderIdentity"])
+	assert.Equal(t, "rabbit@rabbitmq-2.rabbitmq-headless", spec["preferredHolder"])
+	assert.Equal(t, map[string]interface{}{"app": "rabbitmq"}, k8s.lease["metadata"].(map[string]interface{})["labels"])
+}
+
+func TestKubernetesMasterController_SetMaster_ServiceError(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	c := newTestKubernetesMasterController(s.URL)
+
+	err := c.SetMaster("rabbit@rabbitmq-0.rabbitmq-headless")
+	assert.NoError(t, err)
+	acquired := *k8s.decodedLease().Spec.AcquireTime
+
+	k8s.serviceErr = true
+
+	// The lease is restored to the previous master.
+	err = c.SetMaster("rabbit@rabbitmq-1.rabbitmq-headless")
+	assert.EqualError(t, err, "kubernetes: updating service rabbitmq-master to select rabbit@rabbitmq-1.rabbitmq-headless failed: kubernetes: 403: forbidden; the lease was restored to the previous master")
+	assert.IsType(t, &KubernetesServiceError{}, err)
+
+	lease := k8s.decodedLease()
+	assert.Equal(t, "rabbit@rabbitmq-0.rabbitmq-headless", *lease.Spec.HolderIdentity)
+	assert.Equal(t, acquired, *lease.Spec.AcquireTime)
+	assert.Equal(t, 0, *lease.Spec.LeaseTransitions)
+	assert.Equal(t, "rabbitmq-0", k8s.selector[DefaultSelectorLabel])
+
+	// If the lease can't be restored, the error says so.
+	var updates int
+	k8s.beforeUpdate = func() {
+		if updates++; updates == 2 {
+			k8s.resourceVersion++
+		}
+	}
+
+	err = c.SetMaster("rabbit@rabbitmq-1.rabbitmq-headless")
+	if assert.IsType(t, &KubernetesServiceError{}, err) {
+		assert.Equal(t, &kubernetesError{StatusCode: 409, Message: "the object has been modified"}, err.(*KubernetesServiceError).RestoreErr)
+	}
+	assert.Equal(t, "rabbit@rabbitmq-1.rabbitmq-headless", *k8s.decodedLease().Spec.HolderIdentity)
+}
+
+func TestKubernetesMasterController_Unauthorized(t *testing.T) {
+	k8s := newFakeKubernetes()
+	s := httptest.NewServer(k8s)
+	defer s.Close()
+
+	c := newTestKubernetesMasterController(s.URL)
+	c.Token = "wrong"
+
+	_, err := c.Master()
+	assert.Equal(t, &kubernetesError{StatusCode: 401, Message: "Unauthorized"}, err)
+}
+
+func TestPodName(t *testing.T) {
+	tests := []struct {
+		node string
+		pod  string
+	}{
+		{"rabbit@rabbitmq-0.rabbitmq-headless.default.svc.cluster.local", "rabbitmq-0"},
+		{"rabbit@rabbitmq-0", "rabbitmq-0"},
+	}
+
+	for _, tt := range tests {
+		pod, err := podName(tt.node)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.pod, pod)
+	}
+
+	_, err := podName("rabbitmq-0")
+	assert.Equal(t, &InvalidNodeError{Name: "rabbitmq-0"}, err)
+}
+
+func newTestKubernetesMasterController(host string) *KubernetesMasterController {
+	c := NewKubernetesMasterController(host, "default", "rabbitmq-master", "rabbitmq-master")
+	c.Token = "token"
+	return c
+}
+
+// fakeKubernetes is an in memory implementation of the subset of the
+// kubernetes API that KubernetesMasterController uses. The lease is stored as
+// raw json, so that fields KubernetesMasterController doesn't know about can
+// be checked.
+type fakeKubernetes struct {
+	sync.Mutex
+
+	lease           map[string]interface{}
+	resourceVersion int
+	selector        map[string]string
+
+	// Called before the lease is updated.
+	beforeUpdate func()
+
+	// When true, updating the service fails.
+	serviceErr bool
+}
+
+func newFakeKubernetes() *fakeKubernetes {
+	return &fakeKubernetes{
+		selector: map[string]string{"app": "app"},
+	}
+}
+
+const (
+	fakeLeasesPath  = "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+	fakeLeasePath   = fakeLeasesPath + "/rabbitmq-master"
+	fakeServicePath = "/api/v1/namespaces/default/services/rabbitmq-master"
+)
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Unauthorized"})
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == fakeLeasePath:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": `leases.coordination.k8s.io "rabbitmq-master" not found`})
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == "POST" && r.URL.Path == fakeLeasesPath:
+		var lease map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&lease)
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.save(lease)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == "PATCH" && r.URL.Path == fakeLeasePath:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if f.beforeUpdate != nil {
+			f.beforeUpdate()
+		}
+		var patch map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&patch)
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		metadata, _ := patch["metadata"].(map[string]interface{})
+		if metadata["resourceVersion"] != strconv.Itoa(f.resourceVersion) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"message": "the object has been modified"})
+			return
+		}
+		mergePatch(f.lease, patch)
+		f.save(f.lease)
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == "PATCH" && r.URL.Path == fakeServicePath:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if f.serviceErr {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"message": "forbidden"})
+			return
+		}
+		var patch struct {
+			Spec struct {
+				Selector map[string]string `json:"selector"`
+			} `json:"spec"`
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		for k, v := range patch.Spec.Selector {
+			f.selector[k] = v
+		}
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeKubernetes) save(lease map[string]interface{}) {
+	f.resourceVersion++
+	metadata, ok := lease["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		lease["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = strconv.Itoa(f.resourceVersion)
+	f.lease = lease
+}
+
+// decodedLease returns the stored lease decoded into a kubernetesLease.
+func (f *fakeKubernetes) decodedLease() *kubernetesLease {
+	raw, _ := json.Marshal(f.lease)
+	var lease kubernetesLease
+	json.Unmarshal(raw, &lease)
+	return &lease
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to dst.
+func mergePatch(dst, patch map[string]interface{}) {
+	for k, v := range patch {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		d, ok := dst[k].(map[string]interface{})
+		if !ok {
+			d = make(map[string]interface{})
+			dst[k] = d
+		}
+		mergePatch(d, p)
+	}
+}
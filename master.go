@@ -3,7 +3,9 @@ package clusterctl
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -11,6 +13,45 @@ import (
 	"github.com/aws/aws-sdk-go/service/elb"
 )
 
+func init() {
+	RegisterMaster("elb", func(u *MasterURL) (MasterController, error) {
+		m := NewELBMasterController(u.Target)
+
+		timeout, err := u.Duration("health_timeout", DefaultHealthTimeout)
+		if err != nil {
+			return nil, err
+		}
+		m.HealthTimeout = timeout
+
+		return m, nil
+	})
+
+	RegisterMaster("static", func(u *MasterURL) (MasterController, error) {
+		return &staticMasterController{node: u.Target}, nil
+	})
+
+	// Queues are synchronised before changing the master, unless
+	// sync_queues=false. The value can also be the maximum amount of time
+	// to wait (e.g. sync_queues=5m).
+	RegisterDefaultMasterMiddleware("sync_queues", func(m MasterController, value string, opts *MasterOptions) (MasterController, error) {
+		timeout := DefaultSyncTimeout
+		switch value {
+		case "false", "0":
+			return m, nil
+		case "", "true", "1":
+		default:
+			var err error
+			if timeout, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("must be true, false or a duration: %v", err)
+			}
+		}
+
+		c := SyncQueues(m, opts.rabbitmqCtl()).(*syncQueuesMasterController)
+		c.timeout = timeout
+		return c, nil
+	})
+}
+
 // NullMasterController is a MasterController that does nothing.
 var NullMasterController = &staticMasterController{
 	node: "rabbit@localhost",
@@ -22,35 +63,94 @@ type MasterController interface {
 	SetMaster(node string) error
 }
 
+// DefaultHTTPTimeout is the maximum amount of time that a single request made
+// by the consul, etcd, http and kubernetes MasterControllers can take, so that
+// an unresponsive backend can't hang a command or a Watcher's checks.
+const DefaultHTTPTimeout = 30 * time.Second
+
+// httpClient is the client used by MasterControllers with HTTP backends.
+var httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
 type elbClient interface {
 	DescribeLoadBalancers(*elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error)
 	DeregisterInstancesFromLoadBalancer(*elb.DeregisterInstancesFromLoadBalancerInput) (*elb.DeregisterInstancesFromLoadBalancerOutput, error)
 	RegisterInstancesWithLoadBalancer(*elb.RegisterInstancesWithLoadBalancerInput) (*elb.RegisterInstancesWithLoadBalancerOutput, error)
+	DescribeInstanceHealth(*elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error)
+	DescribeLoadBalancerAttributes(*elb.DescribeLoadBalancerAttributesInput) (*elb.DescribeLoadBalancerAttributesOutput, error)
 }
 
 type ec2Client interface {
 	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
 }
 
+// DefaultHealthTimeout is the default amount of time to wait for a new master
+// to become InService with the ELB.
+const DefaultHealthTimeout = 5 * time.Minute
+
+// The ELB instance state of an instance that is passing health checks.
+const instanceStateInService = "InService"
+
 // ELBMasterController implements the MasterController interface using an ELB as
 // the source of truth.
 type ELBMasterController struct {
 	// The ID of the ELB to use.
 	LoadBalancerName string
 
+	// The maximum amount of time to wait for a new master to become
+	// InService. The default is DefaultHealthTimeout.
+	HealthTimeout time.Duration
+
 	elb elbClient
 	ec2 ec2Client
+
+	// The amount of time to wait between checking instance health.
+	pollInterval time.Duration
 }
 
 func NewELBMasterController(loadBalancerName string) *ELBMasterController {
 	s := session.New()
 	return &ELBMasterController{
 		LoadBalancerName: loadBalancerName,
+		HealthTimeout:    DefaultHealthTimeout,
 		elb:              elb.New(s),
 		ec2:              ec2.New(s),
+		pollInterval:     5 * time.Second,
 	}
 }
 
+// InstanceNotInServiceError is returned when a new master does not become
+// InService with the ELB before the timeout.
+type InstanceNotInServiceError struct {
+	InstanceID  string
+	State       string
+	Description string
+}
+
+// Error implements the error interface.
+func (e *InstanceNotInServiceError) Error() string {
+	return fmt.Sprintf("instance %s did not become InService: %s: %s", e.InstanceID, e.State, e.Description)
+}
+
+// RollbackError is returned when a change failed, and undoing the part of it
+// that had already been applied also failed.
+type RollbackError struct {
+	// The error that caused the change to be rolled back.
+	Err error
+
+	// The error from rolling back.
+	RollbackErr error
+}
+
+// Error implements the error interface.
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("%v; rolling back failed: %v", e.Err, e.RollbackErr)
+}
+
+// Unwrap returns the error that caused the change to be rolled back.
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
 // Master returns the node name of the current master.
 func (c *ELBMasterController) Master() (string, error) {
 	hostname, err := c.Hostname()
@@ -70,20 +170,7 @@ func (c *ELBMasterController) Hostname() (string, error) {
 		return "", err
 	}
 
-	resp, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
-		InstanceIds: []*string{aws.String(id)},
-	})
-	if err != nil {
-		return "", err
-	}
-
-	instance := resp.Reservations[0].Instances[0]
-
-	if instance.PrivateDnsName == nil {
-		return "", errNoPrivateDNS
-	}
-
-	return *instance.PrivateDnsName, nil
+	return instanceHostname(c.ec2, id)
 }
 
 var (
@@ -130,20 +217,14 @@ func (c *ELBMasterController) instances() ([]*elb.Instance, error) {
 	return resp.LoadBalancerDescriptions[0].Instances, nil
 }
 
-// http://rubular.com/r/beIh7d7UE3
-var nodeRegexp = regexp.MustCompile(`(\S*)@(\S*)`)
-
-// returns the hostname portion of a rabbitmq node.
-func nodeHostname(node string) string {
-	matches := nodeRegexp.FindStringSubmatch(node)
-	return matches[2]
-}
-
 // SetMaster sets the node to be the new master.
 func (c *ELBMasterController) SetMaster(node string) error {
-	hostname := nodeHostname(node)
+	hostname, err := nodeHost(node)
+	if err != nil {
+		return err
+	}
 
-	id, err := c.instanceWithHostname(hostname)
+	id, err := instanceWithHostname(c.ec2, hostname)
 	if err != nil {
 		return err
 	}
@@ -155,6 +236,36 @@ func (c *ELBMasterController) SetMaster(node string) error {
 	return nil
 }
 
+// MasterHealth returns the health of the master instance, as reported by the
+// load balancer.
+func (c *ELBMasterController) MasterHealth() (*MasterHealth, error) {
+	id, err := c.InstanceID()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.elb.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(c.LoadBalancerName),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.InstanceStates) == 0 {
+		return nil, errNoInstances
+	}
+
+	state := resp.InstanceStates[0]
+	return &MasterHealth{
+		Healthy:     aws.StringValue(state.State) == instanceStateInService,
+		State:       aws.StringValue(state.State),
+		Description: aws.StringValue(state.Description),
+	}, nil
+}
+
 // RemoveInstances removes all ec2 instances from the load balancer.
 func (c *ELBMasterController) RemoveInstances() error {
 	instances, err := c.instances()
@@ -162,49 +273,252 @@ func (c *ELBMasterController) RemoveInstances() error {
 		return err
 	}
 
-	_, err = c.elb.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancerInput{
-		LoadBalancerName: aws.String(c.LoadBalancerName),
-		Instances:        instances,
-	})
-
-	return err
+	return c.deregister(instances)
 }
 
-// SetInstance removes all instances from the load balancer and sets the master
-// to the given instance id.
+// SetInstance sets the master to the given instance id. To avoid a window where
+// no instances are attached to the load balancer, the new instance is
+// registered first, and the existing instances are only deregistered once it's
+// InService. If the new instance doesn't become InService before the timeout,
+// it's deregistered again and the existing instances are left untouched. If
+// deregistering it fails, a *RollbackError is returned, and the new instance may
+// still be attached.
+//
+// When connection draining is enabled, SetInstance waits for the old instances
+// to finish draining before returning.
 func (c *ELBMasterController) SetInstance(instanceID string) error {
-	if err := c.RemoveInstances(); err != nil {
+	instances, err := c.instances()
+	if err != nil {
 		return err
 	}
 
-	_, err := c.elb.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancerInput{
+	var (
+		old        []*elb.Instance
+		registered bool
+	)
+	for _, instance := range instances {
+		if *instance.InstanceId == instanceID {
+			registered = true
+			continue
+		}
+		old = append(old, instance)
+	}
+
+	if !registered {
+		if _, err := c.elb.RegisterInstancesWithLoadBalancer(&elb.RegisterInstancesWithLoadBalancerInput{
+			LoadBalancerName: aws.String(c.LoadBalancerName),
+			Instances: []*elb.Instance{
+				{InstanceId: aws.String(instanceID)},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := c.waitInService(instanceID); err != nil {
+		if !registered {
+			if rollbackErr := c.deregister([]*elb.Instance{{InstanceId: aws.String(instanceID)}}); rollbackErr != nil {
+				return &RollbackError{Err: err, RollbackErr: rollbackErr}
+			}
+		}
+		return err
+	}
+
+	if err := c.deregister(old); err != nil {
+		return err
+	}
+
+	return c.waitDrained(old)
+}
+
+// deregister removes the instances from the load balancer.
+func (c *ELBMasterController) deregister(instances []*elb.Instance) error {
+	if len(instances) == 0 {
+		return nil
+	}
+
+	_, err := c.elb.DeregisterInstancesFromLoadBalancer(&elb.DeregisterInstancesFromLoadBalancerInput{
 		LoadBalancerName: aws.String(c.LoadBalancerName),
-		Instances: []*elb.Instance{
-			{InstanceId: aws.String(instanceID)},
-		},
+		Instances:        instances,
 	})
 
 	return err
 }
 
-const filterPrivateDnsName = "private-dns-name"
+// waitInService waits until the instance is InService with the load balancer.
+func (c *ELBMasterController) waitInService(instanceID string) error {
+	timeout := c.HealthTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthTimeout
+	}
 
-func (c *ELBMasterController) instanceWithHostname(hostname string) (string, error) {
-	resp, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String(filterPrivateDnsName),
-				Values: []*string{aws.String(hostname)},
+	deadline := time.After(timeout)
+	for {
+		resp, err := c.elb.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+			LoadBalancerName: aws.String(c.LoadBalancerName),
+			Instances: []*elb.Instance{
+				{InstanceId: aws.String(instanceID)},
 			},
-		},
+		})
+		if err != nil {
+			return err
+		}
+
+		notInService := &InstanceNotInServiceError{InstanceID: instanceID}
+		for _, state := range resp.InstanceStates {
+			if aws.StringValue(state.State) == instanceStateInService {
+				return nil
+			}
+			notInService.State = aws.StringValue(state.State)
+			notInService.Description = aws.StringValue(state.Description)
+		}
+
+		select {
+		case <-deadline:
+			return notInService
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// waitDrained waits until the deregistered instances have finished connection
+// draining, up to the draining timeout of the load balancer. It returns
+// immediately if connection draining is disabled.
+func (c *ELBMasterController) waitDrained(instances []*elb.Instance) error {
+	if len(instances) == 0 {
+		return nil
+	}
+
+	resp, err := c.elb.DescribeLoadBalancerAttributes(&elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String(c.LoadBalancerName),
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	instance := resp.Reservations[0].Instances[0]
+	draining := resp.LoadBalancerAttributes.ConnectionDraining
+	if draining == nil || !aws.BoolValue(draining.Enabled) {
+		return nil
+	}
 
-	return *instance.InstanceId, nil
+	// Instances that are draining are still reported by
+	// DescribeInstanceHealth until draining has completed.
+	deadline := time.After(time.Duration(aws.Int64Value(draining.Timeout)) * time.Second)
+	for {
+		resp, err := c.elb.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+			LoadBalancerName: aws.String(c.LoadBalancerName),
+		})
+		if err != nil {
+			return err
+		}
+
+		if !anyInstanceState(resp.InstanceStates, instances) {
+			return nil
+		}
+
+		select {
+		case <-deadline:
+			return nil
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// dryRun implements the dryRunner interface.
+func (c *ELBMasterController) dryRun(plan *Plan) {
+	c.elb = &recordingELBClient{
+		elbClient:    c.elb,
+		plan:         plan,
+		registered:   make(map[string]bool),
+		deregistered: make(map[string]bool),
+	}
+}
+
+// recordingELBClient is an elbClient that records changes to the load balancer
+// in a Plan, instead of making them. Instance health reflects the recorded
+// changes, so that waiting for them completes: registered instances are
+// InService, and deregistered instances have finished draining.
+type recordingELBClient struct {
+	elbClient
+	plan *Plan
+
+	registered, deregistered map[string]bool
+}
+
+func (c *recordingELBClient) RegisterInstancesWithLoadBalancer(input *elb.RegisterInstancesWithLoadBalancerInput) (*elb.RegisterInstancesWithLoadBalancerOutput, error) {
+	for _, instance := range input.Instances {
+		id := aws.StringValue(instance.InstanceId)
+		c.registered[id], c.deregistered[id] = true, false
+	}
+
+	c.plan.Record("elb", "RegisterInstancesWithLoadBalancer %s %s", aws.StringValue(input.LoadBalancerName), strings.Join(instanceIDs(input.Instances), ","))
+	return &elb.RegisterInstancesWithLoadBalancerOutput{}, nil
+}
+
+func (c *recordingELBClient) DeregisterInstancesFromLoadBalancer(input *elb.DeregisterInstancesFromLoadBalancerInput) (*elb.DeregisterInstancesFromLoadBalancerOutput, error) {
+	for _, instance := range input.Instances {
+		id := aws.StringValue(instance.InstanceId)
+		c.registered[id], c.deregistered[id] = false, true
+	}
+
+	c.plan.Record("elb", "DeregisterInstancesFromLoadBalancer %s %s", aws.StringValue(input.LoadBalancerName), strings.Join(instanceIDs(input.Instances), ","))
+	return &elb.DeregisterInstancesFromLoadBalancerOutput{}, nil
+}
+
+func (c *recordingELBClient) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	var (
+		states []*elb.InstanceState
+		lookup []*elb.Instance
+	)
+	for _, instance := range input.Instances {
+		if c.registered[aws.StringValue(instance.InstanceId)] {
+			states = append(states, &elb.InstanceState{
+				InstanceId: instance.InstanceId,
+				State:      aws.String(instanceStateInService),
+			})
+			continue
+		}
+		lookup = append(lookup, instance)
+	}
+
+	if len(input.Instances) == 0 || len(lookup) > 0 {
+		resp, err := c.elbClient.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+			LoadBalancerName: input.LoadBalancerName,
+			Instances:        lookup,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, state := range resp.InstanceStates {
+			if !c.deregistered[aws.StringValue(state.InstanceId)] {
+				states = append(states, state)
+			}
+		}
+	}
+
+	return &elb.DescribeInstanceHealthOutput{InstanceStates: states}, nil
+}
+
+// instanceIDs returns the ids of the instances.
+func instanceIDs(instances []*elb.Instance) []string {
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, aws.StringValue(instance.InstanceId))
+	}
+	return ids
+}
+
+// anyInstanceState returns true if any of the instances has a state.
+func anyInstanceState(states []*elb.InstanceState, instances []*elb.Instance) bool {
+	for _, state := range states {
+		for _, instance := range instances {
+			if aws.StringValue(state.InstanceId) == aws.StringValue(instance.InstanceId) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // staticMasterController is a MasterController implementation that manages a
@@ -222,22 +536,119 @@ func (c *staticMasterController) SetMaster(node string) error {
 	return errors.New("master node is static and cannot be changed")
 }
 
+// DefaultSyncTimeout is the default amount of time to wait for queues to
+// synchronise before giving up.
+const DefaultSyncTimeout = 10 * time.Minute
+
 // syncQueuesMasterController is a MasterController middleware that ensures that
 // queues are synchronized on the current node before setting the new master.
 type syncQueuesMasterController struct {
 	MasterController
 	rabbitmqctl rabbitmqctlFunc
+
+	// The maximum amount of time to wait for queues to synchronise.
+	timeout time.Duration
+
+	// The amount of time to wait between checking if queues have
+	// synchronised.
+	pollInterval time.Duration
+
+	// The plan that changes are recorded in, when in dry run mode.
+	plan *Plan
 }
 
 // SyncQueues wraps the MasterController with middleware to ensure that all
-// queues are synchronized before switching to the new master.
-func SyncQueues(m MasterController) MasterController {
+// queues are synchronized before switching to the new master. The given
+// RabbitmqCtl is used to inspect and synchronise queues.
+func SyncQueues(m MasterController, ctl *RabbitmqCtl) MasterController {
 	return &syncQueuesMasterController{
 		MasterController: m,
-		rabbitmqctl:      rabbitmqctl,
+		rabbitmqctl:      ctl.Run,
+		timeout:          DefaultSyncTimeout,
+		pollInterval:     5 * time.Second,
 	}
 }
 
+var errSyncTimeout = errors.New("timed out waiting for queues to synchronise")
+
+// Unwrap returns the wrapped MasterController.
+func (c *syncQueuesMasterController) Unwrap() MasterController {
+	return c.MasterController
+}
+
+// dryRun implements the dryRunner interface. Queue synchronisation is recorded
+// in the plan, and isn't waited for, since it won't happen.
+func (c *syncQueuesMasterController) dryRun(plan *Plan) {
+	c.rabbitmqctl = plan.rabbitmqctl(c.rabbitmqctl)
+	c.plan = plan
+	c.MasterController = dryRunMaster(c.MasterController, plan)
+}
+
+// SetMaster synchronises all queues that have an unsynchronised mirror on the
+// node, waits for synchronisation to complete, then sets the new master.
 func (c *syncQueuesMasterController) SetMaster(node string) error {
-	return errors.New("not implemented")
+	if err := c.syncQueues(node); err != nil {
+		return err
+	}
+
+	return c.MasterController.SetMaster(node)
+}
+
+func (c *syncQueuesMasterController) syncQueues(node string) error {
+	return synchroniseQueues(c.rabbitmqctl, node, c.timeout, c.pollInterval, c.plan)
+}
+
+// synchroniseQueues synchronises all queues that have an unsynchronised mirror
+// on the node, then waits up to timeout for synchronisation to complete. In dry
+// run mode, when plan is not nil, the queues won't synchronise, so it doesn't
+// wait.
+func synchroniseQueues(rabbitmqctl rabbitmqctlFunc, node string, timeout, pollInterval time.Duration, plan *Plan) error {
+	queues, err := unsynchronisedQueues(rabbitmqctl, node)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range queues {
+		if _, err := rabbitmqctl(node, "sync_queue", "-p", q.VHost, q.Name); err != nil {
+			return err
+		}
+	}
+
+	if plan != nil {
+		return nil
+	}
+
+	deadline := time.After(timeout)
+	for len(queues) > 0 {
+		select {
+		case <-deadline:
+			return errSyncTimeout
+		case <-time.After(pollInterval):
+		}
+
+		queues, err = unsynchronisedQueues(rabbitmqctl, node)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unsynchronisedQueues returns the queues that have a mirror on the node that
+// is not synchronised with the master.
+func unsynchronisedQueues(rabbitmqctl rabbitmqctlFunc, node string) ([]*queue, error) {
+	queues, err := listQueues(rabbitmqctl, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var unsynchronised []*queue
+	for _, q := range queues {
+		if q.Unsynchronised(node) {
+			unsynchronised = append(unsynchronised, q)
+		}
+	}
+
+	return unsynchronised, nil
 }
@@ -1,7 +1,9 @@
 package clusterctl
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -166,6 +168,34 @@ func TestELBMasterController_Master_TooManyInstances(t *testing.T) {
 	ec2Client.AssertExpectations(t)
 }
 
+func TestELBMasterController_MasterHealth(t *testing.T) {
+	elbClient := new(mockELBClient)
+	c := &ELBMasterController{
+		LoadBalancerName: "rabbitmq",
+		elb:              elbClient,
+	}
+
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{
+				Instances: []*elb.Instance{
+					{InstanceId: aws.String("i-1234")},
+				},
+			},
+		},
+	}, nil)
+
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-1234")).Return(instanceHealth("i-1234", "InService"), nil)
+
+	health, err := c.MasterHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, &MasterHealth{Healthy: true, State: "InService"}, health)
+
+	elbClient.AssertExpectations(t)
+}
+
 func TestELBMasterController_SetMaster(t *testing.T) {
 	elbClient := new(mockELBClient)
 	ec2Client := new(mockEC2Client)
@@ -204,40 +234,312 @@ func TestELBMasterController_SetMaster(t *testing.T) {
 		},
 	}, nil)
 
+	elbClient.On("RegisterInstancesWithLoadBalancer", &elb.RegisterInstancesWithLoadBalancerInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String("i-3")},
+		},
+	}).Return(&elb.RegisterInstancesWithLoadBalancerOutput{}, nil)
+
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-3")).Return(instanceHealth("i-3", "OutOfService"), nil).Once()
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-3")).Return(instanceHealth("i-3", "InService"), nil).Once()
+
 	elbClient.On("DeregisterInstancesFromLoadBalancer", &elb.DeregisterInstancesFromLoadBalancerInput{
 		LoadBalancerName: aws.String("rabbitmq"),
 		Instances:        instances,
 	}).Return(&elb.DeregisterInstancesFromLoadBalancerOutput{}, nil)
 
+	elbClient.On("DescribeLoadBalancerAttributes", &elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+	}).Return(&elb.DescribeLoadBalancerAttributesOutput{
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionDraining: &elb.ConnectionDraining{Enabled: aws.Bool(false)},
+		},
+	}, nil)
+
+	err := c.SetMaster("rabbit@ip-1.2.3.4.ec2.internal")
+	assert.NoError(t, err)
+
+	elbClient.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestELBMasterController_DefaultNodeTemplate(t *testing.T) {
+	elbClient := new(mockELBClient)
+	ec2Client := new(mockEC2Client)
+	c := &ELBMasterController{
+		LoadBalancerName: "rabbitmq",
+		elb:              elbClient,
+		ec2:              ec2Client,
+	}
+
+	// The hostname of an ec2 instance is its private dns name.
+	node, err := ExpandNodeTemplate(DefaultNodeTemplate, &NodeTemplateData{
+		Prefix: DefaultNodePrefix,
+		hostname: func() (string, error) {
+			return "ip-10-0-0-1.ec2.internal", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("private-dns-name"), Values: []*string{aws.String("ip-10-0-0-1.ec2.internal")}},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{InstanceId: aws.String("i-1")}}},
+		},
+	}, nil)
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String("i-1")},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal")}}},
+		},
+	}, nil)
+
+	// i-1 is already the master, so SetMaster only waits for it to be
+	// InService.
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{Instances: []*elb.Instance{{InstanceId: aws.String("i-1")}}},
+		},
+	}, nil)
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-1")).Return(instanceHealth("i-1", "InService"), nil)
+
+	assert.NoError(t, c.SetMaster(node.String()))
+
+	master, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, node.String(), master)
+
+	elbClient.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestELBMasterController_SetInstance_Rollback(t *testing.T) {
+	elbClient := new(mockELBClient)
+	c := &ELBMasterController{
+		LoadBalancerName: "rabbitmq",
+		HealthTimeout:    10 * time.Millisecond,
+		elb:              elbClient,
+		pollInterval:     time.Millisecond,
+	}
+
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{
+				Instances: []*elb.Instance{
+					{InstanceId: aws.String("i-1")},
+				},
+			},
+		},
+	}, nil)
+
 	elbClient.On("RegisterInstancesWithLoadBalancer", &elb.RegisterInstancesWithLoadBalancerInput{
 		LoadBalancerName: aws.String("rabbitmq"),
 		Instances: []*elb.Instance{
-			{InstanceId: aws.String("i-3")},
+			{InstanceId: aws.String("i-2")},
 		},
 	}).Return(&elb.RegisterInstancesWithLoadBalancerOutput{}, nil)
 
-	err := c.SetMaster("rabbit@ip-1.2.3.4.ec2.internal")
+	unhealthy := instanceHealth("i-2", "OutOfService")
+	unhealthy.InstanceStates[0].Description = aws.String("Instance has failed at least the UnhealthyThreshold number of health checks consecutively.")
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-2")).Return(unhealthy, nil)
+
+	// Only the new instance should be deregistered.
+	elbClient.On("DeregisterInstancesFromLoadBalancer", &elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String("i-2")},
+		},
+	}).Return(&elb.DeregisterInstancesFromLoadBalancerOutput{}, nil)
+
+	err := c.SetInstance("i-2")
+	assert.Equal(t, &InstanceNotInServiceError{
+		InstanceID:  "i-2",
+		State:       "OutOfService",
+		Description: "Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+	}, err)
+
+	elbClient.AssertExpectations(t)
+}
+
+func TestELBMasterController_SetInstance_RollbackError(t *testing.T) {
+	elbClient := new(mockELBClient)
+	c := &ELBMasterController{
+		LoadBalancerName: "rabbitmq",
+		HealthTimeout:    10 * time.Millisecond,
+		elb:              elbClient,
+		pollInterval:     time.Millisecond,
+	}
+
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{
+				Instances: []*elb.Instance{
+					{InstanceId: aws.String("i-1")},
+				},
+			},
+		},
+	}, nil)
+
+	elbClient.On("RegisterInstancesWithLoadBalancer", &elb.RegisterInstancesWithLoadBalancerInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String("i-2")},
+		},
+	}).Return(&elb.RegisterInstancesWithLoadBalancerOutput{}, nil)
+
+	unhealthy := instanceHealth("i-2", "OutOfService")
+	unhealthy.InstanceStates[0].Description = aws.String("Instance is still registering.")
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-2")).Return(unhealthy, nil)
+
+	errThrottled := errors.New("throttled")
+	elbClient.On("DeregisterInstancesFromLoadBalancer", &elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String("i-2")},
+		},
+	}).Return(&elb.DeregisterInstancesFromLoadBalancerOutput{}, errThrottled)
+
+	err := c.SetInstance("i-2")
+	assert.Equal(t, &RollbackError{
+		Err:         &InstanceNotInServiceError{InstanceID: "i-2", State: "OutOfService", Description: "Instance is still registering."},
+		RollbackErr: errThrottled,
+	}, err)
+	assert.EqualError(t, err, "instance i-2 did not become InService: OutOfService: Instance is still registering.; rolling back failed: throttled")
+
+	elbClient.AssertExpectations(t)
+}
+
+func TestELBMasterController_SetInstance_ConnectionDraining(t *testing.T) {
+	elbClient := new(mockELBClient)
+	c := &ELBMasterController{
+		LoadBalancerName: "rabbitmq",
+		elb:              elbClient,
+		pollInterval:     time.Millisecond,
+	}
+
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{
+				Instances: []*elb.Instance{
+					{InstanceId: aws.String("i-1")},
+					{InstanceId: aws.String("i-2")},
+				},
+			},
+		},
+	}, nil)
+
+	// i-2 is already registered, so it shouldn't be registered again.
+	elbClient.On("DescribeInstanceHealth", describeInstanceHealthInput("i-2")).Return(instanceHealth("i-2", "InService"), nil)
+
+	elbClient.On("DeregisterInstancesFromLoadBalancer", &elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String("i-1")},
+		},
+	}).Return(&elb.DeregisterInstancesFromLoadBalancerOutput{}, nil)
+
+	elbClient.On("DescribeLoadBalancerAttributes", &elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+	}).Return(&elb.DescribeLoadBalancerAttributesOutput{
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionDraining: &elb.ConnectionDraining{Enabled: aws.Bool(true), Timeout: aws.Int64(300)},
+		},
+	}, nil)
+
+	draining := &elb.DescribeInstanceHealthInput{LoadBalancerName: aws.String("rabbitmq")}
+	elbClient.On("DescribeInstanceHealth", draining).Return(instanceHealth("i-1", "OutOfService"), nil).Twice()
+	elbClient.On("DescribeInstanceHealth", draining).Return(instanceHealth("i-2", "InService"), nil).Once()
+
+	err := c.SetInstance("i-2")
 	assert.NoError(t, err)
 
 	elbClient.AssertExpectations(t)
-	ec2Client.AssertExpectations(t)
+	elbClient.AssertNotCalled(t, "RegisterInstancesWithLoadBalancer", mock.Anything)
 }
 
-func TestNodeHostname(t *testing.T) {
-	tests := []struct {
-		node     string
-		hostname string
-	}{
-		{"rabbit@master", "master"},
-		{"rabbit@ip-1.2.3.4.ec2.internal", "ip-1.2.3.4.ec2.internal"},
+func TestSyncQueuesMasterController_SetMaster(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &syncQueuesMasterController{
+		MasterController: master,
+		rabbitmqctl:      m.rabbitmqctl,
+		timeout:          time.Second,
 	}
 
-	for _, tt := range tests {
-		hostname := nodeHostname(tt.node)
-		assert.Equal(t, tt.hostname, hostname)
+	m.On("rabbitmqctl", "rabbit@slave", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[]\tclassic\t\t\n"+
+			"jobs\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[<rabbit@slave.1.2.3>]\tclassic\t\t\n", nil).Once()
+	m.On("rabbitmqctl", "rabbit@slave", "sync_queue", []string{"-p", "/", "events"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[<rabbit@slave.1.2.3>]\tclassic\t\t\n"+
+			"jobs\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[<rabbit@slave.1.2.3>]\tclassic\t\t\n", nil).Once()
+	master.On("SetMaster", "rabbit@slave").Return(nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.NoError(t, err)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestSyncQueuesMasterController_SetMaster_Timeout(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &syncQueuesMasterController{
+		MasterController: master,
+		rabbitmqctl:      m.rabbitmqctl,
+		timeout:          10 * time.Millisecond,
+		pollInterval:     time.Millisecond,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[]\tclassic\t\t\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "sync_queue", []string{"-p", "/", "events"}).Return("", nil)
+
+	err := c.SetMaster("rabbit@slave")
+	assert.Equal(t, errSyncTimeout, err)
+
+	master.AssertNotCalled(t, "SetMaster", "rabbit@slave")
+}
+
+func describeInstanceHealthInput(instanceID string) *elb.DescribeInstanceHealthInput {
+	return &elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+		Instances: []*elb.Instance{
+			{InstanceId: aws.String(instanceID)},
+		},
 	}
 }
 
+func instanceHealth(instanceID, state string) *elb.DescribeInstanceHealthOutput {
+	return &elb.DescribeInstanceHealthOutput{
+		InstanceStates: []*elb.InstanceState{
+			{InstanceId: aws.String(instanceID), State: aws.String(state)},
+		},
+	}
+}
+
+func listQueuesArgs(vhost string) []string {
+	return append([]string{"-q", "-p", vhost}, queueColumns...)
+}
+
 type mockEC2Client struct {
 	mock.Mock
 }
@@ -265,3 +567,13 @@ func (m *mockELBClient) RegisterInstancesWithLoadBalancer(input *elb.RegisterIns
 	args := m.Called(input)
 	return args.Get(0).(*elb.RegisterInstancesWithLoadBalancerOutput), args.Error(1)
 }
+
+func (m *mockELBClient) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elb.DescribeInstanceHealthOutput), args.Error(1)
+}
+
+func (m *mockELBClient) DescribeLoadBalancerAttributes(input *elb.DescribeLoadBalancerAttributesInput) (*elb.DescribeLoadBalancerAttributesOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elb.DescribeLoadBalancerAttributesOutput), args.Error(1)
+}
@@ -1,26 +1,89 @@
 package clusterctl
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
 // DefaultMembershipController is a membership controller that uses the
 // rabbitmqctl command.
-var DefaultMembershipController = &RabbitmqCtlMembershipController{
-	rabbitmqctl: rabbitmqctl,
+var DefaultMembershipController = NewRabbitmqCtlMembershipController(DefaultRabbitmqCtl)
+
+// NodeType is the type of a rabbitmq node, which determines whether it stores
+// its internal state on disc or only in RAM.
+type NodeType string
+
+const (
+	NodeTypeDisc NodeType = "disc"
+	NodeTypeRAM  NodeType = "ram"
+)
+
+// ParseNodeType parses a node type from a string (e.g. "disc" or "ram").
+func ParseNodeType(s string) (NodeType, error) {
+	switch t := NodeType(s); t {
+	case NodeTypeDisc, NodeTypeRAM:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid node type %q, must be %q or %q", s, NodeTypeDisc, NodeTypeRAM)
+	}
 }
 
 type JoinNodeOptions struct {
 	Node       string
 	MasterNode string
+
+	// The type of node to join as. The default is a disc node.
+	Type NodeType
+
+	// When true, the node will be reset before the app is restarted if
+	// joining the cluster fails.
+	ResetOnFailure bool
 }
 
+// JoinAction describes the action that was taken when joining a node to the
+// cluster.
+type JoinAction string
+
+const (
+	// JoinActionJoined indicates that the node was joined to the cluster.
+	JoinActionJoined JoinAction = "joined"
+
+	// JoinActionAlreadyMember indicates that the node was already a member
+	// of the masters cluster, so nothing was done.
+	JoinActionAlreadyMember JoinAction = "already_member"
+)
+
 type RemoveNodeOptions struct {
 	Node       string
 	MasterNode string
+
+	// When true, the safety checks that guard against data loss are
+	// skipped.
+	Force bool
+}
+
+type ChangeNodeTypeOptions struct {
+	Node string
+
+	// The type to change the node to.
+	Type NodeType
 }
 
 // MembershipController is an interface for handling cluster membership of
 // individual rabbitmq nodes.
 type MembershipController interface {
-	JoinNode(JoinNodeOptions) error
+	JoinNode(JoinNodeOptions) (JoinAction, error)
 	RemoveNode(RemoveNodeOptions) error
+	ChangeNodeType(ChangeNodeTypeOptions) (changed bool, err error)
+}
+
+// StatusController is an interface for inspecting the state of the cluster.
+type StatusController interface {
+	// ClusterStatus returns the status of the cluster, as seen from the
+	// given node.
+	ClusterStatus(node string) (*ClusterStatus, error)
 }
 
 // membershipController is a MembershipController implementation that uses the
@@ -28,38 +91,373 @@ type MembershipController interface {
 type RabbitmqCtlMembershipController struct {
 	// function to execute to invoke rabbitmqctl.
 	rabbitmqctl rabbitmqctlFunc
+
+	// The amount of time to wait between checking if queues have
+	// synchronised, or clients have reconnected.
+	pollInterval time.Duration
+
+	// The plan that changes are recorded in, when in dry run mode.
+	plan *Plan
+}
+
+// NewRabbitmqCtlMembershipController returns a new
+// RabbitmqCtlMembershipController that uses the given RabbitmqCtl to invoke
+// rabbitmqctl.
+func NewRabbitmqCtlMembershipController(ctl *RabbitmqCtl) *RabbitmqCtlMembershipController {
+	return &RabbitmqCtlMembershipController{
+		rabbitmqctl:  ctl.Run,
+		pollInterval: 5 * time.Second,
+	}
+}
+
+// JoinNode joins the node to the cluster. If the node is already a member of
+// the masters cluster, this is a no-op.
+func (c *RabbitmqCtlMembershipController) JoinNode(options JoinNodeOptions) (JoinAction, error) {
+	status, err := c.ClusterStatus(options.Node)
+	if err != nil {
+		return "", err
+	}
+
+	if status.IsMember(options.MasterNode) {
+		return JoinActionAlreadyMember, nil
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "stop_app"); err != nil {
+		return "", c.recoverJoin(options, "stop_app", err)
+	}
+
+	args := []string{options.MasterNode}
+	if options.Type == NodeTypeRAM {
+		args = append([]string{"--ram"}, args...)
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "join_cluster", args...); err != nil {
+		return "", c.recoverJoin(options, "join_cluster", err)
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "start_app"); err != nil {
+		return "", c.recoverJoin(options, "start_app", err)
+	}
+
+	return JoinActionJoined, nil
 }
 
-// JoinNode joins the node to the cluster.
-func (c *RabbitmqCtlMembershipController) JoinNode(options JoinNodeOptions) error {
-	if err := c.rabbitmqctl(options.Node, "stop_app"); err != nil {
+// recoverJoin attempts to bring the node back into service after joining the
+// cluster failed, so that a failed join doesn't leave the app stopped.
+func (c *RabbitmqCtlMembershipController) recoverJoin(options JoinNodeOptions, step string, err error) error {
+	joinErr := &JoinError{
+		Node: options.Node,
+		Step: step,
+		Err:  err,
+	}
+
+	if options.ResetOnFailure {
+		if _, err := c.rabbitmqctl(options.Node, "reset"); err != nil {
+			joinErr.ResetErr = err
+		} else {
+			joinErr.Reset = true
+		}
+	}
+
+	// Always attempt to start the app, even if the reset failed.
+	if _, err := c.rabbitmqctl(options.Node, "start_app"); err != nil {
+		joinErr.StartErr = err
+	}
+
+	return joinErr
+}
+
+var (
+	errLastDiscNode = errors.New("cannot change the last disc node in the cluster to a ram node")
+	errNotMember    = errors.New("node is not a member of the cluster")
+)
+
+// ChangeNodeType changes the type of the node, and returns whether it was
+// changed. If the node is already of the given type, this is a no-op. A node
+// cannot be changed to a ram node if it's the last disc node in the cluster.
+// If changing the type fails, the app is restarted and a *ChangeNodeTypeError
+// is returned.
+func (c *RabbitmqCtlMembershipController) ChangeNodeType(options ChangeNodeTypeOptions) (bool, error) {
+	if _, err := ParseNodeType(string(options.Type)); err != nil {
+		return false, err
+	}
+
+	status, err := c.ClusterStatus(options.Node)
+	if err != nil {
+		return false, err
+	}
+
+	if !status.IsMember(options.Node) {
+		return false, errNotMember
+	}
+
+	if status.IsDisc(options.Node) == (options.Type == NodeTypeDisc) {
+		return false, nil
+	}
+
+	if options.Type == NodeTypeRAM && len(status.DiscNodes) < 2 {
+		return false, errLastDiscNode
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "stop_app"); err != nil {
+		return false, c.recoverChangeNodeType(options, "stop_app", err)
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "change_cluster_node_type", string(options.Type)); err != nil {
+		return false, c.recoverChangeNodeType(options, "change_cluster_node_type", err)
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "start_app"); err != nil {
+		return false, c.recoverChangeNodeType(options, "start_app", err)
+	}
+
+	return true, nil
+}
+
+// recoverChangeNodeType attempts to restart the app after changing the type of
+// the node failed, so that the node isn't left stopped.
+func (c *RabbitmqCtlMembershipController) recoverChangeNodeType(options ChangeNodeTypeOptions, step string, err error) error {
+	changeErr := &ChangeNodeTypeError{
+		Node: options.Node,
+		Type: options.Type,
+		Step: step,
+		Err:  err,
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "start_app"); err != nil {
+		changeErr.StartErr = err
+	}
+
+	return changeErr
+}
+
+// ChangeNodeTypeError is returned when changing the type of a node fails.
+type ChangeNodeTypeError struct {
+	Node string
+
+	// The type that the node was being changed to.
+	Type NodeType
+
+	// The rabbitmqctl command that failed.
+	Step string
+
+	// The error returned from the failing command.
+	Err error
+
+	// The error that occurred when restarting the app during recovery. If
+	// this is not nil, the app may be stopped.
+	StartErr error
+}
+
+// Error implements the error interface.
+func (e *ChangeNodeTypeError) Error() string {
+	msg := fmt.Sprintf("changing %s to a %s node failed at %s: %v", e.Node, e.Type, e.Step, e.Err)
+
+	if e.StartErr != nil {
+		return fmt.Sprintf("%s; restarting the app failed, the app may be stopped: %v", msg, e.StartErr)
+	}
+
+	return fmt.Sprintf("%s; the app was restarted", msg)
+}
+
+// Unwrap returns the error from the failing command.
+func (e *ChangeNodeTypeError) Unwrap() error {
+	return e.Err
+}
+
+// JoinError is returned when joining a node to the cluster fails.
+type JoinError struct {
+	Node string
+
+	// The rabbitmqctl command that failed.
+	Step string
+
+	// The error returned from the failing command.
+	Err error
+
+	// Whether the node was reset during recovery.
+	Reset bool
+
+	// The error that occurred when resetting the node during recovery, if
+	// ResetOnFailure was set.
+	ResetErr error
+
+	// The error that occurred when restarting the app during recovery. If
+	// this is not nil, the app may be stopped.
+	StartErr error
+}
+
+// Error implements the error interface.
+func (e *JoinError) Error() string {
+	msg := fmt.Sprintf("joining %s to the cluster failed at %s: %v", e.Node, e.Step, e.Err)
+
+	switch {
+	case e.ResetErr != nil:
+		msg = fmt.Sprintf("%s; reset failed: %v", msg, e.ResetErr)
+	case e.Reset:
+		msg = fmt.Sprintf("%s; node was reset", msg)
+	}
+
+	if e.StartErr != nil {
+		return fmt.Sprintf("%s; restarting the app failed, the app may be stopped: %v", msg, e.StartErr)
+	}
+
+	return fmt.Sprintf("%s; the app was restarted", msg)
+}
+
+// Unwrap returns the error from the failing command.
+func (e *JoinError) Unwrap() error {
+	return e.Err
+}
+
+// ClusterStatus returns the status of the cluster, as seen from the given node.
+func (c *RabbitmqCtlMembershipController) ClusterStatus(node string) (*ClusterStatus, error) {
+	return clusterStatus(c.rabbitmqctl, node)
+}
+
+// RemoveNode removes the node from the cluster. Unless Force is set, removal is
+// refused if it could result in data loss. See CheckRemoveNode.
+func (c *RabbitmqCtlMembershipController) RemoveNode(options RemoveNodeOptions) error {
+	if !options.Force {
+		if err := c.CheckRemoveNode(options); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.rabbitmqctl(options.Node, "stop_app"); err != nil {
 		return err
 	}
 
-	if err := c.rabbitmqctl(options.Node, "join_cluster", options.MasterNode); err != nil {
+	if _, err := c.rabbitmqctl(options.MasterNode, "forget_cluster_node", options.Node); err != nil {
 		return err
 	}
 
-	if err := c.rabbitmqctl(options.Node, "start_app"); err != nil {
+	if _, err := c.rabbitmqctl(options.Node, "reset"); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// RemoveNode removes the node from the cluster.
-func (c *RabbitmqCtlMembershipController) RemoveNode(options RemoveNodeOptions) error {
-	if err := c.rabbitmqctl(options.Node, "stop_app"); err != nil {
-		return err
+// CheckRemoveNode checks that it's safe to remove the node from the cluster,
+// returning a *RemoveRefusedError if it's not. It's not safe to remove a node
+// when:
+//
+//  1. It's the current master.
+//  2. It's the last disc node in the cluster.
+//  3. It hosts a queue master that has no synchronised mirrors on other nodes.
+//  4. Stopping it would leave a quorum queue without a majority of members.
+func (c *RabbitmqCtlMembershipController) CheckRemoveNode(options RemoveNodeOptions) error {
+	refused := &RemoveRefusedError{Node: options.Node}
+
+	if options.Node == options.MasterNode {
+		refused.Reasons = append(refused.Reasons, "it is the current master")
 	}
 
-	if err := c.rabbitmqctl(options.MasterNode, "forget_cluster_node", options.Node); err != nil {
+	status, err := c.ClusterStatus(options.MasterNode)
+	if err != nil {
 		return err
 	}
 
-	if err := c.rabbitmqctl(options.Node, "reset"); err != nil {
+	if status.IsDisc(options.Node) && len(status.DiscNodes) == 1 {
+		refused.Reasons = append(refused.Reasons, "it is the last disc node in the cluster")
+	}
+
+	queues, err := listQueues(c.rabbitmqctl, options.MasterNode)
+	if err != nil {
 		return err
 	}
 
+	for _, q := range queues {
+		if reason := removeBlocker(q, options.Node); reason != "" {
+			refused.Queues = append(refused.Queues, BlockingQueue{
+				VHost:  q.VHost,
+				Name:   q.Name,
+				Reason: reason,
+			})
+		}
+	}
+
+	if len(refused.Queues) > 0 {
+		refused.Reasons = append(refused.Reasons, "it hosts queues that would lose data or availability")
+	}
+
+	if len(refused.Reasons) > 0 {
+		return refused
+	}
+
 	return nil
 }
+
+// removeBlocker returns the reason that removing node would be unsafe for the
+// queue, or an empty string if it's safe.
+func removeBlocker(q *queue, node string) string {
+	if q.Quorum() {
+		if !contains(q.Members, node) {
+			return ""
+		}
+
+		var online int
+		for _, n := range q.OnlineNodes {
+			if n != node && contains(q.Members, n) {
+				online++
+			}
+		}
+
+		if majority := len(q.Members)/2 + 1; online < majority {
+			return fmt.Sprintf("quorum queue would have %d of %d members online, below a majority of %d", online, len(q.Members), majority)
+		}
+
+		return ""
+	}
+
+	if q.Node != node {
+		return ""
+	}
+
+	for _, n := range q.SynchronisedSlaveNodes {
+		if n != node {
+			return ""
+		}
+	}
+
+	return "queue master has no synchronised mirrors on other nodes"
+}
+
+// BlockingQueue is a queue that prevents a node from being removed safely.
+type BlockingQueue struct {
+	VHost string
+	Name  string
+
+	// Why removing the node would be unsafe for this queue.
+	Reason string
+}
+
+// RemoveRefusedError is returned when removing a node is refused because it
+// could result in data loss.
+type RemoveRefusedError struct {
+	Node string
+
+	// The reasons that removal was refused.
+	Reasons []string
+
+	// The queues that need to be migrated or synchronised before the node
+	// can be removed.
+	Queues []BlockingQueue
+}
+
+// Error implements the error interface.
+func (e *RemoveRefusedError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "refusing to remove %s: %s", e.Node, strings.Join(e.Reasons, ", "))
+
+	if len(e.Queues) > 0 {
+		b.WriteString("\nblocking queues:")
+		for _, q := range e.Queues {
+			fmt.Fprintf(&b, "\n  vhost=%s queue=%s: %s", q.VHost, q.Name, q.Reason)
+		}
+	}
+
+	return b.String()
+}
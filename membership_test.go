@@ -1,6 +1,8 @@
 package clusterctl
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,28 +15,197 @@ func TestMembershipController_JoinNode(t *testing.T) {
 		rabbitmqctl: m.rabbitmqctl,
 	}
 
-	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return(nil)
-	m.On("rabbitmqctl", "rabbit@slave", "join_cluster", []string{"rabbit@master"}).Return(nil)
-	m.On("rabbitmqctl", "rabbit@slave", "start_app", emptyArgs).Return(nil)
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "join_cluster", []string{"rabbit@master"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "start_app", emptyArgs).Return("", nil)
 
-	err := c.JoinNode(JoinNodeOptions{
+	action, err := c.JoinNode(JoinNodeOptions{
 		Node:       "rabbit@slave",
 		MasterNode: "rabbit@master",
 	})
 	assert.NoError(t, err)
+	assert.Equal(t, JoinActionJoined, action)
 
 	m.AssertExpectations(t)
 }
 
+func TestMembershipController_JoinNode_RAM(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "join_cluster", []string{"--ram", "rabbit@master"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "start_app", emptyArgs).Return("", nil)
+
+	action, err := c.JoinNode(JoinNodeOptions{
+		Node:       "rabbit@slave",
+		MasterNode: "rabbit@master",
+		Type:       NodeTypeRAM,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, JoinActionJoined, action)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_JoinNode_AlreadyMember(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+
+	action, err := c.JoinNode(JoinNodeOptions{
+		Node:       "rabbit@slave",
+		MasterNode: "rabbit@master",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, JoinActionAlreadyMember, action)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_JoinNode_Master(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master"), nil)
+
+	action, err := c.JoinNode(JoinNodeOptions{
+		Node:       "rabbit@master",
+		MasterNode: "rabbit@master",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, JoinActionAlreadyMember, action)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_JoinNode_Failure(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		// The step that fails.
+		step string
+
+		options JoinNodeOptions
+
+		// The calls expected to recover the node, and the errors
+		// returned by reset and start_app.
+		recovery []string
+		resetErr error
+		startErr error
+
+		err string
+	}{
+		{
+			step:     "stop_app",
+			recovery: []string{"start_app"},
+			err:      "joining rabbit@slave to the cluster failed at stop_app: boom; the app was restarted",
+		},
+		{
+			step:     "join_cluster",
+			recovery: []string{"start_app"},
+			err:      "joining rabbit@slave to the cluster failed at join_cluster: boom; the app was restarted",
+		},
+		{
+			step:     "start_app",
+			recovery: []string{"start_app"},
+			err:      "joining rabbit@slave to the cluster failed at start_app: boom; the app was restarted",
+		},
+		{
+			step:     "join_cluster",
+			options:  JoinNodeOptions{ResetOnFailure: true},
+			recovery: []string{"reset", "start_app"},
+			err:      "joining rabbit@slave to the cluster failed at join_cluster: boom; node was reset; the app was restarted",
+		},
+		{
+			step:     "join_cluster",
+			recovery: []string{"start_app"},
+			startErr: errors.New("node down"),
+			err:      "joining rabbit@slave to the cluster failed at join_cluster: boom; restarting the app failed, the app may be stopped: node down",
+		},
+		{
+			step:     "join_cluster",
+			options:  JoinNodeOptions{ResetOnFailure: true},
+			recovery: []string{"reset", "start_app"},
+			resetErr: errors.New("mnesia busy"),
+			err:      "joining rabbit@slave to the cluster failed at join_cluster: boom; reset failed: mnesia busy; the app was restarted",
+		},
+		{
+			step:     "join_cluster",
+			options:  JoinNodeOptions{ResetOnFailure: true},
+			recovery: []string{"reset", "start_app"},
+			resetErr: errors.New("mnesia busy"),
+			startErr: errors.New("node down"),
+			err:      "joining rabbit@slave to the cluster failed at join_cluster: boom; reset failed: mnesia busy; restarting the app failed, the app may be stopped: node down",
+		},
+	}
+
+	for _, tt := range tests {
+		m := new(mockRabbitmqCtl)
+		c := &RabbitmqCtlMembershipController{
+			rabbitmqctl: m.rabbitmqctl,
+		}
+
+		steps := []struct {
+			command string
+			args    []string
+		}{
+			{"stop_app", emptyArgs},
+			{"join_cluster", []string{"rabbit@master"}},
+			{"start_app", emptyArgs},
+		}
+
+		m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@slave"), nil)
+		for _, step := range steps {
+			if step.command == tt.step {
+				m.On("rabbitmqctl", "rabbit@slave", step.command, step.args).Return("", errBoom).Once()
+				break
+			}
+			m.On("rabbitmqctl", "rabbit@slave", step.command, step.args).Return("", nil).Once()
+		}
+		for _, command := range tt.recovery {
+			err := tt.startErr
+			if command == "reset" {
+				err = tt.resetErr
+			}
+			m.On("rabbitmqctl", "rabbit@slave", command, emptyArgs).Return("", err).Once()
+		}
+
+		options := tt.options
+		options.Node = "rabbit@slave"
+		options.MasterNode = "rabbit@master"
+
+		_, err := c.JoinNode(options)
+		assert.EqualError(t, err, tt.err)
+		assert.True(t, errors.Is(err, errBoom))
+
+		m.AssertExpectations(t)
+	}
+}
+
 func TestMembershipController_RemoveNode(t *testing.T) {
 	m := new(mockRabbitmqCtl)
 	c := &RabbitmqCtlMembershipController{
 		rabbitmqctl: m.rabbitmqctl,
 	}
 
-	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return(nil)
-	m.On("rabbitmqctl", "rabbit@master", "forget_cluster_node", []string{"rabbit@slave"}).Return(nil)
-	m.On("rabbitmqctl", "rabbit@slave", "reset", emptyArgs).Return(nil)
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@slave.1.2.3>\t[<rabbit@master.1.2.3>]\t[<rabbit@master.1.2.3>]\tclassic\t\t\n"+
+			"orders\t<rabbit@slave.1.2.3>\t\t\tquorum\t[rabbit@master, rabbit@slave, rabbit@other]\t[rabbit@master, rabbit@slave, rabbit@other]\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@master", "forget_cluster_node", []string{"rabbit@slave"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "reset", emptyArgs).Return("", nil)
 
 	err := c.RemoveNode(RemoveNodeOptions{
 		Node:       "rabbit@slave",
@@ -45,6 +216,301 @@ func TestMembershipController_RemoveNode(t *testing.T) {
 	m.AssertExpectations(t)
 }
 
+func TestMembershipController_RemoveNode_Refused(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@slave.1.2.3>\t[<rabbit@master.1.2.3>]\t[]\tclassic\t\t\n"+
+			"jobs\t<rabbit@slave.1.2.3>\t\t\tclassic\t\t\n"+
+			"mirrored\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[]\tclassic\t\t\n"+
+			"orders\t<rabbit@master.1.2.3>\t\t\tquorum\t[rabbit@master, rabbit@slave, rabbit@other]\t[rabbit@master, rabbit@slave]\n", nil)
+
+	err := c.RemoveNode(RemoveNodeOptions{
+		Node:       "rabbit@slave",
+		MasterNode: "rabbit@master",
+	})
+	assert.Equal(t, &RemoveRefusedError{
+		Node:    "rabbit@slave",
+		Reasons: []string{"it hosts queues that would lose data or availability"},
+		Queues: []BlockingQueue{
+			{VHost: "/", Name: "events", Reason: "queue master has no synchronised mirrors on other nodes"},
+			{VHost: "/", Name: "jobs", Reason: "queue master has no synchronised mirrors on other nodes"},
+			{VHost: "/", Name: "orders", Reason: "quorum queue would have 1 of 3 members online, below a majority of 2"},
+		},
+	}, err)
+	assert.Equal(t, `refusing to remove rabbit@slave: it hosts queues that would lose data or availability
+blocking queues:
+  vhost=/ queue=events: queue master has no synchronised mirrors on other nodes
+  vhost=/ queue=jobs: queue master has no synchronised mirrors on other nodes
+  vhost=/ queue=orders: quorum queue would have 1 of 3 members online, below a majority of 2`, err.Error())
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_RemoveNode_RefusedMaster(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master"), nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_queues", listQueuesArgs("/")).Return("", nil)
+
+	err := c.RemoveNode(RemoveNodeOptions{
+		Node:       "rabbit@master",
+		MasterNode: "rabbit@master",
+	})
+	assert.Equal(t, &RemoveRefusedError{
+		Node:    "rabbit@master",
+		Reasons: []string{"it is the current master", "it is the last disc node in the cluster"},
+	}, err)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_RemoveNode_Force(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@master", "stop_app", emptyArgs).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@master", "forget_cluster_node", []string{"rabbit@master"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@master", "reset", emptyArgs).Return("", nil)
+
+	err := c.RemoveNode(RemoveNodeOptions{
+		Node:       "rabbit@master",
+		MasterNode: "rabbit@master",
+		Force:      true,
+	})
+	assert.NoError(t, err)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ChangeNodeType(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@slave", "stop_app", emptyArgs).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "change_cluster_node_type", []string{"ram"}).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "start_app", emptyArgs).Return("", nil)
+
+	changed, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+		Node: "rabbit@slave",
+		Type: NodeTypeRAM,
+	})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ChangeNodeType_AlreadyType(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+
+	changed, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+		Node: "rabbit@slave",
+		Type: NodeTypeDisc,
+	})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ChangeNodeType_LastDiscNode(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master"), nil)
+
+	_, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+		Node: "rabbit@master",
+		Type: NodeTypeRAM,
+	})
+	assert.Equal(t, errLastDiscNode, err)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ChangeNodeType_NotMember(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	c := &RabbitmqCtlMembershipController{
+		rabbitmqctl: m.rabbitmqctl,
+	}
+
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master"), nil)
+
+	_, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+		Node: "rabbit@slave",
+		Type: NodeTypeRAM,
+	})
+	assert.Equal(t, errNotMember, err)
+
+	m.AssertExpectations(t)
+}
+
+func TestMembershipController_ChangeNodeType_Failure(t *testing.T) {
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		// The step that fails.
+		step string
+
+		// The error returned when restarting the app.
+		startErr error
+
+		err string
+	}{
+		{
+			step: "stop_app",
+			err:  "changing rabbit@slave to a ram node failed at stop_app: boom; the app was restarted",
+		},
+		{
+			step: "change_cluster_node_type",
+			err:  "changing rabbit@slave to a ram node failed at change_cluster_node_type: boom; the app was restarted",
+		},
+		{
+			step:     "change_cluster_node_type",
+			startErr: errors.New("node down"),
+			err:      "changing rabbit@slave to a ram node failed at change_cluster_node_type: boom; restarting the app failed, the app may be stopped: node down",
+		},
+		{
+			step: "start_app",
+			err:  "changing rabbit@slave to a ram node failed at start_app: boom; the app was restarted",
+		},
+	}
+
+	for _, tt := range tests {
+		m := new(mockRabbitmqCtl)
+		c := &RabbitmqCtlMembershipController{
+			rabbitmqctl: m.rabbitmqctl,
+		}
+
+		steps := []struct {
+			command string
+			args    []string
+		}{
+			{"stop_app", emptyArgs},
+			{"change_cluster_node_type", []string{"ram"}},
+			{"start_app", emptyArgs},
+		}
+
+		m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+		for _, step := range steps {
+			if step.command == tt.step {
+				m.On("rabbitmqctl", "rabbit@slave", step.command, step.args).Return("", errBoom).Once()
+				break
+			}
+			m.On("rabbitmqctl", "rabbit@slave", step.command, step.args).Return("", nil).Once()
+		}
+		m.On("rabbitmqctl", "rabbit@slave", "start_app", emptyArgs).Return("", tt.startErr).Once()
+
+		_, err := c.ChangeNodeType(ChangeNodeTypeOptions{
+			Node: "rabbit@slave",
+			Type: NodeTypeRAM,
+		})
+		assert.EqualError(t, err, tt.err)
+		assert.True(t, errors.Is(err, errBoom))
+
+		m.AssertExpectations(t)
+	}
+}
+
+func TestParseNodeType(t *testing.T) {
+	tests := []struct {
+		in  string
+		out NodeType
+		err bool
+	}{
+		{"disc", NodeTypeDisc, false},
+		{"ram", NodeTypeRAM, false},
+		{"disk", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		nodeType, err := ParseNodeType(tt.in)
+		assert.Equal(t, tt.out, nodeType)
+		assert.Equal(t, tt.err, err != nil)
+	}
+}
+
+func TestMembershipController_JoinNode_Argv(t *testing.T) {
+	r := &argvRecorder{
+		stdout: map[string]string{
+			"cluster_status": clusterStatusOutput("rabbit@slave"),
+		},
+	}
+	c := NewRabbitmqCtlMembershipController(&RabbitmqCtl{Longnames: true, exec: r.exec})
+
+	_, err := c.JoinNode(JoinNodeOptions{
+		Node:       "rabbit@slave",
+		MasterNode: "rabbit@master",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, [][]string{
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "cluster_status", "--formatter", "json"},
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "stop_app"},
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "join_cluster", "rabbit@master"},
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "start_app"},
+	}, r.argv)
+}
+
+func TestMembershipController_RemoveNode_Argv(t *testing.T) {
+	r := new(argvRecorder)
+	c := NewRabbitmqCtlMembershipController(&RabbitmqCtl{Longnames: true, exec: r.exec})
+
+	err := c.RemoveNode(RemoveNodeOptions{
+		Node:       "rabbit@slave",
+		MasterNode: "rabbit@master",
+		Force:      true,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, [][]string{
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "stop_app"},
+		{"rabbitmqctl", "-n", "rabbit@master", "--longnames", "forget_cluster_node", "rabbit@slave"},
+		{"rabbitmqctl", "-n", "rabbit@slave", "--longnames", "reset"},
+	}, r.argv)
+}
+
+// clusterStatusArgs are the arguments passed to rabbitmqctl to get the cluster
+// status.
+var clusterStatusArgs = []string{"--formatter", "json"}
+
+// clusterStatusOutput returns the json output of `rabbitmqctl cluster_status`
+// for a cluster of running disc nodes.
+func clusterStatusOutput(nodes ...string) string {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"cluster_name":  nodes[0],
+		"disk_nodes":    nodes,
+		"ram_nodes":     []string{},
+		"running_nodes": nodes,
+		"partitions":    map[string][]string{},
+		"alarms":        []interface{}{},
+	})
+	return string(raw)
+}
+
 // emptyArgs is a niladic []string.
 var emptyArgs []string
 
@@ -52,7 +518,7 @@ type mockRabbitmqCtl struct {
 	mock.Mock
 }
 
-func (m *mockRabbitmqCtl) rabbitmqctl(node string, command string, arg ...string) error {
+func (m *mockRabbitmqCtl) rabbitmqctl(node string, command string, arg ...string) (string, error) {
 	args := m.Called(node, command, arg)
-	return args.Error(0)
+	return args.String(0), args.Error(1)
 }
@@ -0,0 +1,159 @@
+package clusterctl
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// DefaultNodePrefix is the default prefix of rabbitmq node names.
+const DefaultNodePrefix = "rabbit"
+
+// DefaultNodeTemplate is the default template for the name of the local node.
+// The hostname is used as is, the same as the private dns names that the ec2
+// based MasterControllers report the master with.
+const DefaultNodeTemplate = "{{.Prefix}}@{{.Hostname}}"
+
+// Node is a rabbitmq node name of the form prefix@host.
+type Node struct {
+	Prefix string
+	Host   string
+}
+
+// InvalidNodeError is returned when a node name is not of the form
+// prefix@host.
+type InvalidNodeError struct {
+	Name string
+}
+
+// Error implements the error interface.
+func (e *InvalidNodeError) Error() string {
+	return fmt.Sprintf("invalid node name %q, must be of the form prefix@host", e.Name)
+}
+
+// ParseNode parses a node name of the form prefix@host.
+func ParseNode(name string) (Node, error) {
+	parts := strings.SplitN(name, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "@") || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return Node{}, &InvalidNodeError{Name: name}
+	}
+
+	return Node{Prefix: parts[0], Host: parts[1]}, nil
+}
+
+// String returns the node name.
+func (n Node) String() string {
+	return n.Prefix + "@" + n.Host
+}
+
+// nodeHost returns the host portion of a node name.
+func nodeHost(name string) (string, error) {
+	n, err := ParseNode(name)
+	if err != nil {
+		return "", err
+	}
+	return n.Host, nil
+}
+
+// NodeTemplateData is the data that's available to node name templates. Values
+// that require a lookup are methods, so they're only looked up when the
+// template uses them.
+type NodeTemplateData struct {
+	// The node name prefix. The default is DefaultNodePrefix.
+	Prefix string
+
+	hostname    func() (string, error)
+	lookupHost  func(string) ([]string, error)
+	lookupAddr  func(string) ([]string, error)
+	ec2Metadata func(string) (string, error)
+}
+
+// NewNodeTemplateData returns NodeTemplateData for the local host.
+func NewNodeTemplateData() *NodeTemplateData {
+	return &NodeTemplateData{
+		Prefix:     DefaultNodePrefix,
+		hostname:   os.Hostname,
+		lookupHost: net.LookupHost,
+		lookupAddr: net.LookupAddr,
+		ec2Metadata: func(path string) (string, error) {
+			return ec2metadata.New(session.New()).GetMetadata(path)
+		},
+	}
+}
+
+// Hostname returns the hostname of the local host, as reported by the kernel.
+func (d *NodeTemplateData) Hostname() (string, error) {
+	return d.hostname()
+}
+
+// ShortHostname returns the hostname of the local host, up to the first ".".
+func (d *NodeTemplateData) ShortHostname() (string, error) {
+	hostname, err := d.hostname()
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(hostname, ".", 2)[0], nil
+}
+
+// FQDN returns the fully qualified domain name of the local host, as determined
+// by a reverse lookup of its address.
+func (d *NodeTemplateData) FQDN() (string, error) {
+	hostname, err := d.hostname()
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := d.lookupHost(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		names, err := d.lookupAddr(addr)
+		if err != nil || len(names) == 0 {
+			continue
+		}
+		return strings.TrimSuffix(names[0], "."), nil
+	}
+
+	return "", fmt.Errorf("unable to determine the FQDN of %s", hostname)
+}
+
+// EC2PrivateDNS returns the private dns name of the ec2 instance, from the
+// instance metadata service.
+func (d *NodeTemplateData) EC2PrivateDNS() (string, error) {
+	return d.ec2Metadata("local-hostname")
+}
+
+// PodName returns the name of the kubernetes pod that we're running in. It's
+// taken from $POD_NAME if set (e.g. with the downward API), otherwise the
+// hostname, which kubernetes sets to the pod name.
+func (d *NodeTemplateData) PodName() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return d.hostname()
+}
+
+// ExpandNodeTemplate expands a node name template (e.g.
+// {{.Prefix}}@{{.FQDN}}), and validates the result.
+func ExpandNodeTemplate(tmpl string, data *NodeTemplateData) (Node, error) {
+	t, err := template.New("node").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return Node{}, fmt.Errorf("invalid node template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return Node{}, fmt.Errorf("invalid node template: %v", err)
+	}
+
+	return ParseNode(buf.String())
+}
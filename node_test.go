@@ -0,0 +1,82 @@
+package clusterctl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNode(t *testing.T) {
+	tests := []struct {
+		name string
+		node Node
+	}{
+		{"rabbit@master", Node{Prefix: "rabbit", Host: "master"}},
+		{"rabbit@ip-1.2.3.4.ec2.internal", Node{Prefix: "rabbit", Host: "ip-1.2.3.4.ec2.internal"}},
+		{"hare@localhost", Node{Prefix: "hare", Host: "localhost"}},
+	}
+
+	for _, tt := range tests {
+		node, err := ParseNode(tt.name)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.node, node)
+		assert.Equal(t, tt.name, node.String())
+	}
+
+	for _, name := range []string{"", "master", "@master", "rabbit@", "rabbit@a@b", "rabbit@ master"} {
+		_, err := ParseNode(name)
+		assert.Equal(t, &InvalidNodeError{Name: name}, err)
+	}
+}
+
+func TestExpandNodeTemplate(t *testing.T) {
+	data := &NodeTemplateData{
+		Prefix: "rabbit",
+		hostname: func() (string, error) {
+			return "ip-10-0-0-1.ec2.internal", nil
+		},
+		lookupHost: func(host string) ([]string, error) {
+			assert.Equal(t, "ip-10-0-0-1.ec2.internal", host)
+			return []string{"10.0.0.1"}, nil
+		},
+		lookupAddr: func(addr string) ([]string, error) {
+			assert.Equal(t, "10.0.0.1", addr)
+			return []string{"ip-10-0-0-1.ec2.internal."}, nil
+		},
+		ec2Metadata: func(path string) (string, error) {
+			assert.Equal(t, "local-hostname", path)
+			return "ip-10-0-0-1.us-west-2.compute.internal", nil
+		},
+	}
+
+	tests := []struct {
+		template string
+		node     string
+	}{
+		{DefaultNodeTemplate, "rabbit@ip-10-0-0-1.ec2.internal"},
+		{"{{.Prefix}}@{{.ShortHostname}}", "rabbit@ip-10-0-0-1"},
+		{"{{.Prefix}}@{{.FQDN}}", "rabbit@ip-10-0-0-1.ec2.internal"},
+		{"rabbit@{{.EC2PrivateDNS}}", "rabbit@ip-10-0-0-1.us-west-2.compute.internal"},
+		{"rabbit@{{.PodName}}", "rabbit@ip-10-0-0-1.ec2.internal"},
+		{"hare@static", "hare@static"},
+	}
+
+	for _, tt := range tests {
+		node, err := ExpandNodeTemplate(tt.template, data)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.node, node.String())
+	}
+
+	_, err := ExpandNodeTemplate("{{.Hostname}}", data)
+	assert.Equal(t, &InvalidNodeError{Name: "ip-10-0-0-1.ec2.internal"}, err)
+
+	_, err = ExpandNodeTemplate("{{.Unknown}}", data)
+	assert.Error(t, err)
+
+	data.ec2Metadata = func(path string) (string, error) {
+		return "", errors.New("EC2MetadataError: failed to make Client request")
+	}
+	_, err = ExpandNodeTemplate("rabbit@{{.EC2PrivateDNS}}", data)
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package clusterctl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PlanStep is a change that would have been made, recorded in dry run mode.
+type PlanStep struct {
+	// The service that the change would be made with (e.g. "rabbitmqctl"
+	// or "elb").
+	Service string `json:"service" yaml:"service"`
+
+	// The command or API call, and its arguments.
+	Operation string `json:"operation" yaml:"operation"`
+}
+
+// String returns the step as a single line.
+func (s PlanStep) String() string {
+	return s.Service + " " + s.Operation
+}
+
+// Plan records the changes that operations would make, in the order that they
+// would be made, when a Controller is in dry run mode.
+type Plan struct {
+	mu    sync.Mutex
+	steps []PlanStep
+}
+
+// Record records a change.
+func (p *Plan) Record(service, format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.steps = append(p.steps, PlanStep{
+		Service:   service,
+		Operation: fmt.Sprintf(format, args...),
+	})
+}
+
+// Steps returns the recorded changes.
+func (p *Plan) Steps() []PlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]PlanStep(nil), p.steps...)
+}
+
+// readOnlyCommands are the rabbitmqctl commands that don't change the state of
+// a node, so they're still run in dry run mode.
+var readOnlyCommands = []string{
+	"cluster_status",
+	"status",
+	"environment",
+	"report",
+}
+
+// rabbitmqctl returns a rabbitmqctlFunc that records commands that change the
+// state of a node, instead of running them with f. Commands that only read
+// state, like list_queues, are still run with f, so that the plan reflects the
+// current state of the cluster.
+func (p *Plan) rabbitmqctl(f rabbitmqctlFunc) rabbitmqctlFunc {
+	return func(node string, command string, arg ...string) (string, error) {
+		if contains(readOnlyCommands, command) || strings.HasPrefix(command, "list_") {
+			return f(node, command, arg...)
+		}
+
+		p.Record("rabbitmqctl", "%s", strings.Join(append([]string{"-n", node, command}, arg...), " "))
+		return "", nil
+	}
+}
+
+// dryRunner is implemented by MasterControllers, MembershipControllers and
+// middleware that can record the changes they would make in a Plan, instead of
+// making them.
+type dryRunner interface {
+	dryRun(plan *Plan)
+}
+
+// dryRunMaster puts the MasterController into dry run mode. Middleware puts the
+// MasterController that it wraps into dry run mode too. MasterControllers that
+// don't support dry run mode are wrapped, so that SetMaster records the new
+// master without calling them.
+func dryRunMaster(m MasterController, plan *Plan) MasterController {
+	if d, ok := m.(dryRunner); ok {
+		d.dryRun(plan)
+		return m
+	}
+
+	return &dryRunMasterController{MasterController: m, plan: plan}
+}
+
+// dryRunMasterController is a MasterController middleware that records
+// SetMaster calls in a Plan.
+type dryRunMasterController struct {
+	MasterController
+	plan *Plan
+}
+
+// Unwrap returns the wrapped MasterController.
+func (c *dryRunMasterController) Unwrap() MasterController {
+	return c.MasterController
+}
+
+// SetMaster records the new master.
+func (c *dryRunMasterController) SetMaster(node string) error {
+	c.plan.Record("master", "SetMaster %s (%T)", node, c.MasterController)
+	return nil
+}
+
+// DryRun puts the controller into dry run mode. Changes to nodes and to the
+// master are recorded in the plan, in order, instead of being made, and are
+// returned in the OperationResult of each operation. The current state of the
+// cluster and the master is still read, so the plan reflects what would happen
+// if the operation was performed now.
+func (c *Controller) DryRun(plan *Plan) error {
+	d, ok := c.MembershipController.(dryRunner)
+	if !ok {
+		return fmt.Errorf("%T does not support dry run mode", c.MembershipController)
+	}
+	d.dryRun(plan)
+
+	c.MasterController = dryRunMaster(c.MasterController, plan)
+	c.plan = plan
+	return nil
+}
+
+// dryRun implements the dryRunner interface.
+func (c *RabbitmqCtlMembershipController) dryRun(plan *Plan) {
+	c.rabbitmqctl = plan.rabbitmqctl(c.rabbitmqctl)
+	c.plan = plan
+}
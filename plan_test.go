@@ -0,0 +1,121 @@
+package clusterctl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController_DryRun_Remove(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	plan := new(Plan)
+	assert.NoError(t, c.DryRun(plan))
+
+	master.On("Master").Return("rabbit@master", nil)
+	m.On("rabbitmqctl", "rabbit@master", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@master", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[<rabbit@slave.1.2.3>]\tclassic\t\t\n", nil)
+
+	r, err := c.Remove(false)
+	assert.NoError(t, err)
+	assert.True(t, r.DryRun)
+	assert.Equal(t, []PlanStep{
+		{Service: "rabbitmqctl", Operation: "-n rabbit@slave stop_app"},
+		{Service: "rabbitmqctl", Operation: "-n rabbit@master forget_cluster_node rabbit@slave"},
+		{Service: "rabbitmqctl", Operation: "-n rabbit@slave reset"},
+	}, r.Plan)
+
+	m.AssertExpectations(t)
+	master.AssertExpectations(t)
+}
+
+func TestDryRunMaster_SyncQueuesELB(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	elbClient := new(mockELBClient)
+	ec2Client := new(mockEC2Client)
+	c := &syncQueuesMasterController{
+		MasterController: &ELBMasterController{
+			LoadBalancerName: "rabbitmq",
+			elb:              elbClient,
+			ec2:              ec2Client,
+		},
+		rabbitmqctl: m.rabbitmqctl,
+		timeout:     time.Second,
+	}
+
+	plan := new(Plan)
+	assert.Equal(t, c, dryRunMaster(c, plan))
+
+	m.On("rabbitmqctl", "rabbit@ip-1.2.3.4.ec2.internal", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@ip-1.2.3.4.ec2.internal", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@ip-1.2.3.4.ec2.internal.1.2.3>]\t[]\tclassic\t\t\n", nil)
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("private-dns-name"), Values: []*string{aws.String("ip-1.2.3.4.ec2.internal")}},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{Instances: []*ec2.Instance{{InstanceId: aws.String("i-2")}}},
+		},
+	}, nil)
+
+	elbClient.On("DescribeLoadBalancers", &elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String("rabbitmq")},
+	}).Return(&elb.DescribeLoadBalancersOutput{
+		LoadBalancerDescriptions: []*elb.LoadBalancerDescription{
+			{Instances: []*elb.Instance{{InstanceId: aws.String("i-1")}}},
+		},
+	}, nil)
+
+	elbClient.On("DescribeLoadBalancerAttributes", &elb.DescribeLoadBalancerAttributesInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+	}).Return(&elb.DescribeLoadBalancerAttributesOutput{
+		LoadBalancerAttributes: &elb.LoadBalancerAttributes{
+			ConnectionDraining: &elb.ConnectionDraining{Enabled: aws.Bool(true), Timeout: aws.Int64(300)},
+		},
+	}, nil)
+
+	// The old master is still reported, since it was never actually
+	// deregistered.
+	elbClient.On("DescribeInstanceHealth", &elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String("rabbitmq"),
+	}).Return(instanceHealth("i-1", "InService"), nil)
+
+	err := c.SetMaster("rabbit@ip-1.2.3.4.ec2.internal")
+	assert.NoError(t, err)
+	assert.Equal(t, []PlanStep{
+		{Service: "rabbitmqctl", Operation: "-n rabbit@ip-1.2.3.4.ec2.internal sync_queue -p / events"},
+		{Service: "elb", Operation: "RegisterInstancesWithLoadBalancer rabbitmq i-2"},
+		{Service: "elb", Operation: "DeregisterInstancesFromLoadBalancer rabbitmq i-1"},
+	}, plan.Steps())
+
+	m.AssertExpectations(t)
+	elbClient.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestDryRunMaster_Unsupported(t *testing.T) {
+	master := new(mockMasterController)
+	plan := new(Plan)
+
+	m := dryRunMaster(master, plan)
+	assert.NoError(t, m.SetMaster("rabbit@slave"))
+	assert.Equal(t, []PlanStep{
+		{Service: "master", Operation: "SetMaster rabbit@slave (*clusterctl.mockMasterController)"},
+	}, plan.Steps())
+
+	master.AssertExpectations(t)
+}
@@ -0,0 +1,211 @@
+package clusterctl
+
+import (
+	"errors"
+	"strings"
+)
+
+// queue represents a single queue, as reported by `rabbitmqctl list_queues`.
+type queue struct {
+	VHost string
+	Name  string
+
+	// The type of queue (e.g. "classic" or "quorum"). This will be empty
+	// for versions of rabbitmq that don't support quorum queues.
+	Type string
+
+	// The node that hosts the queue master or, for quorum queues, the
+	// leader.
+	Node string
+
+	// The nodes that host a mirror of this queue.
+	SlaveNodes []string
+
+	// The nodes that host a mirror of this queue that is synchronised with
+	// the master.
+	SynchronisedSlaveNodes []string
+
+	// For quorum queues, the nodes that are members of the queue, and the
+	// members that are currently online.
+	Members     []string
+	OnlineNodes []string
+}
+
+// Quorum returns true if this is a quorum queue.
+func (q *queue) Quorum() bool {
+	return q.Type == "quorum"
+}
+
+// Unsynchronised returns true if the node hosts a mirror of this queue that is
+// not synchronised with the master.
+func (q *queue) Unsynchronised(node string) bool {
+	return contains(q.SlaveNodes, node) && !contains(q.SynchronisedSlaveNodes, node)
+}
+
+// The columns that we request from `rabbitmqctl list_queues`.
+var (
+	queueColumns = []string{"name", "pid", "slave_pids", "synchronised_slave_pids", "type", "members", "online"}
+
+	// Versions of rabbitmq without quorum queues don't support the type,
+	// members and online columns.
+	classicQueueColumns = queueColumns[:4]
+)
+
+// listQueues returns all of the queues, in all vhosts, as seen from the given
+// node.
+func listQueues(rabbitmqctl rabbitmqctlFunc, node string) ([]*queue, error) {
+	vhosts, err := listVHosts(rabbitmqctl, node)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := queueColumns
+
+	var queues []*queue
+	for _, vhost := range vhosts {
+		out, err := rabbitmqctl(node, "list_queues", append([]string{"-q", "-p", vhost}, columns...)...)
+		if err != nil && errors.Is(err, ErrUsage) && len(columns) > len(classicQueueColumns) {
+			columns = classicQueueColumns
+			out, err = rabbitmqctl(node, "list_queues", append([]string{"-q", "-p", vhost}, columns...)...)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fields := range parseTable(out, columns) {
+			q := &queue{
+				VHost:                  vhost,
+				Name:                   fields[0],
+				Node:                   pidNode(fields[1]),
+				SlaveNodes:             pidNodes(fields[2]),
+				SynchronisedSlaveNodes: pidNodes(fields[3]),
+			}
+
+			if len(fields) > 4 {
+				q.Type = fields[4]
+				q.Members = listNodes(fields[5])
+				q.OnlineNodes = listNodes(fields[6])
+			}
+
+			queues = append(queues, q)
+		}
+	}
+
+	return queues, nil
+}
+
+// listVHosts returns the names of all vhosts.
+func listVHosts(rabbitmqctl rabbitmqctlFunc, node string) ([]string, error) {
+	columns := []string{"name"}
+
+	out, err := rabbitmqctl(node, "list_vhosts", append([]string{"-q"}, columns...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var vhosts []string
+	for _, fields := range parseTable(out, columns) {
+		vhosts = append(vhosts, fields[0])
+	}
+
+	return vhosts, nil
+}
+
+// parseTable parses the tab separated output from one of the rabbitmqctl list_*
+// commands. Informational lines (e.g. "Listing queues ...") and the table
+// header, which some versions of rabbitmqctl print even when -q is given, are
+// skipped.
+func parseTable(out string, columns []string) [][]string {
+	header := strings.Join(columns, "\t")
+
+	var rows [][]string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if line == "" || line == header {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(columns) {
+			continue
+		}
+
+		if len(columns) == 1 && isInfoLine(line) {
+			continue
+		}
+
+		rows = append(rows, fields)
+	}
+
+	return rows
+}
+
+// isInfoLine returns true if the line looks like one of the informational
+// messages that older versions of rabbitmqctl print around tabular output.
+func isInfoLine(line string) bool {
+	return strings.HasPrefix(line, "Listing ") || strings.HasPrefix(line, "Timeout: ") || line == "...done."
+}
+
+// pidNodes parses a list of erlang pids (e.g. "[<rabbit@a.1.2.3>, <rabbit@b.1.2.3>]")
+// and returns the nodes that they belong to.
+func pidNodes(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	var nodes []string
+	for _, pid := range strings.Split(s, ",") {
+		if node := pidNode(pid); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// listNodes parses a list of nodes (e.g. "[rabbit@a, rabbit@b]").
+func listNodes(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "[")
+	s = strings.TrimSuffix(s, "]")
+
+	var nodes []string
+	for _, node := range strings.Split(s, ",") {
+		node = strings.Trim(strings.TrimSpace(node), "'")
+		if strings.Contains(node, "@") {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// pidNode returns the node portion of an erlang pid, as formatted by
+// rabbitmqctl (e.g. "<rabbit@ip-1-2-3-4.ec2.internal.1.2.3>").
+func pidNode(pid string) string {
+	pid = strings.TrimSpace(pid)
+	pid = strings.TrimPrefix(pid, "<")
+	pid = strings.TrimSuffix(pid, ">")
+
+	if !strings.Contains(pid, "@") {
+		return ""
+	}
+
+	// Strip the 3 numeric components that follow the node name.
+	parts := strings.Split(pid, ".")
+	if len(parts) > 3 {
+		parts = parts[:len(parts)-3]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
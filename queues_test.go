@@ -0,0 +1,78 @@
+package clusterctl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListQueues(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+
+	m.On("rabbitmqctl", "rabbit@a", "list_vhosts", []string{"-q", "name"}).Return("Listing vhosts ...\nname\n/\nstaging\n", nil)
+	m.On("rabbitmqctl", "rabbit@a", "list_queues", listQueuesArgs("/")).Return(
+		"name\tpid\tslave_pids\tsynchronised_slave_pids\ttype\tmembers\tonline\n"+
+			"events\t<rabbit@ip-1-2-3-4.ec2.internal.1.2.3>\t[<rabbit@b.1.2.3>, <rabbit@c.4.5.6>]\t[<rabbit@c.4.5.6>]\tclassic\t\t\n"+
+			"orders\t<rabbit@a.1.2.3>\t\t\tquorum\t[rabbit@a, rabbit@b, rabbit@c]\t[rabbit@a, rabbit@b]\n", nil)
+	m.On("rabbitmqctl", "rabbit@a", "list_queues", listQueuesArgs("staging")).Return(
+		"Listing queues ...\n"+
+			"jobs\t<rabbit@a.1.2.3>\t\t\tclassic\t\t\n"+
+			"...done.\n", nil)
+
+	queues, err := listQueues(m.rabbitmqctl, "rabbit@a")
+	assert.NoError(t, err)
+	assert.Equal(t, []*queue{
+		{
+			VHost:                  "/",
+			Name:                   "events",
+			Type:                   "classic",
+			Node:                   "rabbit@ip-1-2-3-4.ec2.internal",
+			SlaveNodes:             []string{"rabbit@b", "rabbit@c"},
+			SynchronisedSlaveNodes: []string{"rabbit@c"},
+		},
+		{
+			VHost:       "/",
+			Name:        "orders",
+			Type:        "quorum",
+			Node:        "rabbit@a",
+			Members:     []string{"rabbit@a", "rabbit@b", "rabbit@c"},
+			OnlineNodes: []string{"rabbit@a", "rabbit@b"},
+		},
+		{
+			VHost: "staging",
+			Name:  "jobs",
+			Type:  "classic",
+			Node:  "rabbit@a",
+		},
+	}, queues)
+
+	assert.True(t, queues[0].Unsynchronised("rabbit@b"))
+	assert.False(t, queues[0].Unsynchronised("rabbit@c"))
+	assert.False(t, queues[2].Unsynchronised("rabbit@b"))
+	assert.True(t, queues[1].Quorum())
+
+	m.AssertExpectations(t)
+}
+
+func TestListQueues_Classic(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+
+	m.On("rabbitmqctl", "rabbit@a", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@a", "list_queues", listQueuesArgs("/")).Return("", &RabbitmqCtlError{Err: ErrUsage})
+	m.On("rabbitmqctl", "rabbit@a", "list_queues", append([]string{"-q", "-p", "/"}, classicQueueColumns...)).Return(
+		"events\t<rabbit@a.1.2.3>\t[<rabbit@b.1.2.3>]\t[<rabbit@b.1.2.3>]\n", nil)
+
+	queues, err := listQueues(m.rabbitmqctl, "rabbit@a")
+	assert.NoError(t, err)
+	assert.Equal(t, []*queue{
+		{
+			VHost:                  "/",
+			Name:                   "events",
+			Node:                   "rabbit@a",
+			SlaveNodes:             []string{"rabbit@b"},
+			SynchronisedSlaveNodes: []string{"rabbit@b"},
+		},
+	}, queues)
+
+	m.AssertExpectations(t)
+}
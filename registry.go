@@ -0,0 +1,294 @@
+package clusterctl
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MasterFactory returns a new MasterController configured from a master URL.
+// Factories read query options with MasterURL.Get or MasterURL.Duration, which
+// record the options as used, and options that aren't used are an error.
+type MasterFactory func(u *MasterURL) (MasterController, error)
+
+// MasterMiddleware wraps a MasterController. value is the value of the query
+// option that the middleware was registered under.
+type MasterMiddleware func(m MasterController, value string, opts *MasterOptions) (MasterController, error)
+
+// MasterOptions are passed to middleware when building a MasterController from
+// a master URL.
+type MasterOptions struct {
+	// The RabbitmqCtl to use to inspect nodes.
+	RabbitmqCtl *RabbitmqCtl
+}
+
+func (o *MasterOptions) rabbitmqCtl() *RabbitmqCtl {
+	if o.RabbitmqCtl == nil {
+		return DefaultRabbitmqCtl
+	}
+	return o.RabbitmqCtl
+}
+
+var (
+	registryMu       sync.Mutex
+	masterFactories  = make(map[string]MasterFactory)
+	masterMiddleware = make(map[string]MasterMiddleware)
+
+	// Options of middleware that's applied even when the option isn't
+	// given, in the order that they were registered.
+	defaultMiddleware []string
+)
+
+// RegisterMaster makes a MasterController backend available for the given URL
+// scheme. It's intended to be called from the init function of the file that
+// implements the backend, and panics if the scheme is registered twice.
+func RegisterMaster(scheme string, f MasterFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := masterFactories[scheme]; ok {
+		panic(fmt.Sprintf("clusterctl: master scheme %q registered twice", scheme))
+	}
+	masterFactories[scheme] = f
+}
+
+// RegisterMasterMiddleware makes a MasterController middleware available as a
+// query option of master URLs. It panics if the option is registered twice.
+func RegisterMasterMiddleware(option string, m MasterMiddleware) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := masterMiddleware[option]; ok {
+		panic(fmt.Sprintf("clusterctl: master middleware %q registered twice", option))
+	}
+	masterMiddleware[option] = m
+}
+
+// RegisterDefaultMasterMiddleware is like RegisterMasterMiddleware, but the
+// middleware is also applied, with an empty value, to master URLs that don't
+// include the option. Default middleware is the innermost, in the order that
+// it was registered, so the middleware must accept a value that disables it.
+func RegisterDefaultMasterMiddleware(option string, m MasterMiddleware) {
+	RegisterMasterMiddleware(option, m)
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	defaultMiddleware = append(defaultMiddleware, option)
+}
+
+// MasterSchemes returns the registered master URL schemes.
+func MasterSchemes() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	var schemes []string
+	for scheme := range masterFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewMasterController returns a new MasterController for the master URL (e.g.
+// elb://rabbitmq?sync_queues=5m). Query options that match registered
+// middleware wrap the MasterController, in the order that they appear, so the
+// first option is the innermost middleware. Default middleware that isn't in
+// the URL is applied first.
+func NewMasterController(rawurl string, opts *MasterOptions) (MasterController, error) {
+	u, err := ParseMasterURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	registryMu.Lock()
+	f, ok := masterFactories[u.Scheme]
+	var (
+		middleware []MasterMiddleware
+		options    []string
+		defaults   []string
+	)
+	for _, option := range defaultMiddleware {
+		if _, ok := u.values[option]; !ok {
+			defaults = append(defaults, option)
+		}
+	}
+	for _, option := range append(defaults, u.options...) {
+		if mw, ok := masterMiddleware[option]; ok {
+			middleware = append(middleware, mw)
+			options = append(options, option)
+		}
+	}
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown master scheme %q, must be one of %s", u.Scheme, strings.Join(MasterSchemes(), ", "))
+	}
+
+	for _, option := range options {
+		u.Query.Del(option)
+	}
+
+	m, err := f(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if unused := u.unused(); len(unused) > 0 {
+		return nil, fmt.Errorf("unknown option %s for master scheme %q", strings.Join(unused, ", "), u.Scheme)
+	}
+
+	if opts == nil {
+		opts = &MasterOptions{}
+	}
+
+	for i, mw := range middleware {
+		m, err = mw(m, u.values[options[i]], opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", options[i], err)
+		}
+	}
+
+	return m, nil
+}
+
+// MasterURL is a parsed master URL of the form scheme://target?options. Unlike
+// net/url, the target is kept opaque, since it's often something that isn't a
+// valid host, like an ARN or a node name.
+type MasterURL struct {
+	Scheme string
+
+	// Everything between "://" and "?".
+	Target string
+
+	// The query options that weren't consumed by middleware. Factories
+	// should read them with Get, so that they're recorded as used.
+	Query url.Values
+
+	// The query options in the order that they appear, and their first
+	// values.
+	options []string
+	values  map[string]string
+
+	// The query options that were used by the factory.
+	used map[string]bool
+}
+
+// ParseMasterURL parses a master URL.
+func ParseMasterURL(rawurl string) (*MasterURL, error) {
+	i := strings.Index(rawurl, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid master URL %q, must be of the form scheme://target", rawurl)
+	}
+
+	u := &MasterURL{
+		Scheme: strings.ToLower(rawurl[:i]),
+		Target: rawurl[i+3:],
+		Query:  make(url.Values),
+		values: make(map[string]string),
+		used:   make(map[string]bool),
+	}
+
+	var rawQuery string
+	if j := strings.Index(u.Target, "?"); j >= 0 {
+		u.Target, rawQuery = u.Target[:j], u.Target[j+1:]
+	}
+
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		key, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var value string
+		if len(parts) == 2 {
+			if value, err = url.QueryUnescape(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, ok := u.values[key]; !ok {
+			u.options = append(u.options, key)
+			u.values[key] = value
+		}
+		u.Query.Add(key, value)
+	}
+
+	return u, nil
+}
+
+// Host returns the part of the target before the first "/".
+func (u *MasterURL) Host() string {
+	return strings.SplitN(u.Target, "/", 2)[0]
+}
+
+// Path returns the part of the target after the first "/".
+func (u *MasterURL) Path() string {
+	parts := strings.SplitN(u.Target, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Get returns the first value of the query option, and records that the option
+// was used.
+func (u *MasterURL) Get(option string) string {
+	u.used[option] = true
+	return u.Query.Get(option)
+}
+
+// Duration returns the value of the query option as a duration, or def if it's
+// not set.
+func (u *MasterURL) Duration(option string, def time.Duration) (time.Duration, error) {
+	v := u.Get(option)
+	if v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", option, err)
+	}
+
+	return d, nil
+}
+
+// String returns the URL, with the query options that weren't consumed by
+// middleware.
+func (u *MasterURL) String() string {
+	s := u.Scheme + "://" + u.Target
+	if len(u.Query) > 0 {
+		s += "?" + u.Query.Encode()
+	}
+	return s
+}
+
+// URL is like String, but records all of the query options as used, for
+// backends that use the URL as is.
+func (u *MasterURL) URL() string {
+	for option := range u.Query {
+		u.used[option] = true
+	}
+	return u.String()
+}
+
+// unused returns the query options that weren't used by middleware or the
+// factory, in the order that they appear.
+func (u *MasterURL) unused() []string {
+	var unused []string
+	for _, option := range u.options {
+		if _, ok := u.Query[option]; ok && !u.used[option] {
+			unused = append(unused, option)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,101 @@
+package clusterctl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMasterURL(t *testing.T) {
+	tests := []struct {
+		raw    string
+		scheme string
+		target string
+		query  url.Values
+	}{
+		{"elb://rabbitmq", "elb", "rabbitmq", url.Values{}},
+		{"elbv2://arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/rabbitmq/abcdef?target_type=ip", "elbv2", "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/rabbitmq/abcdef", url.Values{"target_type": {"ip"}}},
+		{"consul://127.0.0.1:8500/rabbitmq/master", "consul", "127.0.0.1:8500/rabbitmq/master", url.Values{}},
+		{"file:///etc/rabbitmq/master", "file", "/etc/rabbitmq/master", url.Values{}},
+		{"static://rabbit@localhost?sync_queues", "static", "rabbit@localhost", url.Values{"sync_queues": {""}}},
+	}
+
+	for _, tt := range tests {
+		u, err := ParseMasterURL(tt.raw)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.scheme, u.Scheme)
+		assert.Equal(t, tt.target, u.Target)
+		assert.Equal(t, tt.query, u.Query)
+	}
+
+	_, err := ParseMasterURL("rabbitmq")
+	assert.Error(t, err)
+}
+
+func TestMasterURL_HostPath(t *testing.T) {
+	u, err := ParseMasterURL("consul://127.0.0.1:8500/rabbitmq/master")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8500", u.Host())
+	assert.Equal(t, "rabbitmq/master", u.Path())
+}
+
+func TestNewMasterController(t *testing.T) {
+	m, err := NewMasterController("static://rabbit@localhost?sync_queues=false", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &staticMasterController{node: "rabbit@localhost"}, m)
+
+	m, err = NewMasterController("consul://127.0.0.1:8500/rabbitmq/master?token=secret&sync_queues=false", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8500", m.(*ConsulMasterController).Address)
+	assert.Equal(t, "rabbitmq/master", m.(*ConsulMasterController).Key)
+	assert.Equal(t, "secret", m.(*ConsulMasterController).Token)
+
+	m, err = NewMasterController("http://config/master?env=production&sync_queues=false", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://config/master?env=production", m.(*HTTPMasterController).URL)
+
+	_, err = NewMasterController("foo://bar", nil)
+	assert.Error(t, err)
+
+	// Options that aren't used by the backend or middleware are an error.
+	_, err = NewMasterController("elb://rabbitmq?helth_timeout=1m&sync_queue=true", nil)
+	assert.EqualError(t, err, `unknown option helth_timeout, sync_queue for master scheme "elb"`)
+
+	_, err = NewMasterController("static://rabbit@localhost?health_timeout=1m", nil)
+	assert.EqualError(t, err, `unknown option health_timeout for master scheme "static"`)
+}
+
+func TestNewMasterController_Middleware(t *testing.T) {
+	ctl := &RabbitmqCtl{Path: "/usr/sbin/rabbitmqctl"}
+
+	m, err := NewMasterController("file:///tmp/master?sync_queues=1m&dynamodb_lock=locks", &MasterOptions{RabbitmqCtl: ctl})
+	assert.NoError(t, err)
+
+	// The first option should be the innermost middleware.
+	lock := m.(*dynamodbLockMasterController)
+	assert.Equal(t, "locks", lock.table)
+
+	sync := lock.MasterController.(*syncQueuesMasterController)
+	assert.Equal(t, time.Minute, sync.timeout)
+	assert.Equal(t, NewFileMasterController("/tmp/master"), sync.MasterController)
+
+	_, err = NewMasterController("file:///tmp/master?sync_queues=always", nil)
+	assert.Error(t, err)
+}
+
+func TestNewMasterController_DefaultMiddleware(t *testing.T) {
+	// Queues are synchronised unless sync_queues=false.
+	m, err := NewMasterController("file:///tmp/master?dynamodb_lock=locks", nil)
+	assert.NoError(t, err)
+
+	lock := m.(*dynamodbLockMasterController)
+	sync := lock.MasterController.(*syncQueuesMasterController)
+	assert.Equal(t, DefaultSyncTimeout, sync.timeout)
+	assert.Equal(t, NewFileMasterController("/tmp/master"), sync.MasterController)
+
+	m, err = NewMasterController("file:///tmp/master?sync_queues=false", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, NewFileMasterController("/tmp/master"), m)
+}
@@ -0,0 +1,120 @@
+package clusterctl
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Operations that can be performed by a Controller.
+const (
+	OperationMaster   = "master"
+	OperationJoin     = "join"
+	OperationRemove   = "remove"
+	OperationPromote  = "promote"
+	OperationSetType  = "set-type"
+	OperationCampaign = "campaign"
+)
+
+// Actions that are reported in an OperationResult, in addition to the
+// JoinActions.
+const (
+	ActionNone        = "none"
+	ActionRemoved     = "removed"
+	ActionPromoted    = "promoted"
+	ActionTypeChanged = "type_changed"
+	ActionElected     = "elected"
+)
+
+// OperationResult is the result of an operation performed by a Controller.
+type OperationResult struct {
+	// The operation that was performed (e.g. "promote").
+	Operation string `json:"operation" yaml:"operation"`
+
+	// The node that the operation was performed on.
+	Node string `json:"node" yaml:"node"`
+
+	// What was done (e.g. "joined", or "already_member" when nothing had
+	// to be done).
+	Action string `json:"action" yaml:"action"`
+
+	// How long the operation took.
+	Duration time.Duration `json:"duration" yaml:"duration"`
+
+	// The master before the operation, when the operation can change it,
+	// and the master after the operation.
+	PreviousMaster string `json:"previous_master,omitempty" yaml:"previous_master,omitempty"`
+	Master         string `json:"master,omitempty" yaml:"master,omitempty"`
+
+	// The state of the nodes in the cluster after the operation, when the
+	// MembershipController is a StatusController.
+	Nodes []NodeState `json:"nodes,omitempty" yaml:"nodes,omitempty"`
+
+	// In dry run mode, the changes that would have been made, in order.
+	DryRun bool       `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+	Plan   []PlanStep `json:"plan,omitempty" yaml:"plan,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. The duration is encoded
+// as a string (e.g. "1.5s"), the same as it is in YAML.
+func (r *OperationResult) MarshalJSON() ([]byte, error) {
+	type result OperationResult
+	return json.Marshal(struct {
+		*result
+		Duration string `json:"duration"`
+	}{(*result)(r), r.Duration.String()})
+}
+
+// NodeState is the state of a single node in the cluster.
+type NodeState struct {
+	Name    string   `json:"name" yaml:"name"`
+	Type    NodeType `json:"type" yaml:"type"`
+	Running bool     `json:"running" yaml:"running"`
+}
+
+// NodeStates returns the state of every node in the cluster.
+func (s *ClusterStatus) NodeStates() []NodeState {
+	var states []NodeState
+	for _, node := range s.Nodes() {
+		state := NodeState{Name: node, Type: NodeTypeRAM, Running: s.IsRunning(node)}
+		if s.IsDisc(node) {
+			state.Type = NodeTypeDisc
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// newResult returns a new OperationResult for an operation on the current node
+// that started at start.
+func (c *Controller) newResult(operation string, start time.Time) *OperationResult {
+	r := &OperationResult{
+		Operation: operation,
+		Node:      c.Node,
+		Duration:  time.Since(start),
+	}
+
+	if c.plan != nil {
+		r.DryRun = true
+		r.Plan = c.plan.Steps()
+	}
+
+	return r
+}
+
+// nodeStates returns the state of the nodes in the cluster, as seen from the
+// current node. It returns nil if the MembershipController can't report the
+// cluster status, or the status can't be determined, since it's informational
+// only and the operation has already been performed.
+func (c *Controller) nodeStates() []NodeState {
+	status, ok := c.MembershipController.(StatusController)
+	if !ok {
+		return nil
+	}
+
+	cluster, err := status.ClusterStatus(c.Node)
+	if err != nil {
+		return nil
+	}
+
+	return cluster.NodeStates()
+}
@@ -0,0 +1,296 @@
+package clusterctl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// DefaultRecordTTL is the default TTL of the master record, in seconds. It's
+// kept low so that clients follow a new master quickly.
+const DefaultRecordTTL = 10
+
+// DefaultChangeTimeout is the default amount of time to wait for a change to
+// the master record to reach INSYNC.
+const DefaultChangeTimeout = 2 * time.Minute
+
+func init() {
+	// route53://<hosted zone id>/<record name>?type=CNAME&ttl=10
+	RegisterMaster("route53", func(u *MasterURL) (MasterController, error) {
+		m := NewRoute53MasterController(u.Host(), u.Path())
+
+		if t := u.Get("type"); t != "" {
+			m.RecordType = strings.ToUpper(t)
+		}
+
+		if ttl := u.Get("ttl"); ttl != "" {
+			seconds, err := strconv.ParseInt(ttl, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl: %v", err)
+			}
+			m.TTL = seconds
+		}
+
+		timeout, err := u.Duration("timeout", DefaultChangeTimeout)
+		if err != nil {
+			return nil, err
+		}
+		m.Timeout = timeout
+
+		return m, nil
+	})
+}
+
+type route53Client interface {
+	ListResourceRecordSets(*route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error)
+	ChangeResourceRecordSets(*route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	GetChange(*route53.GetChangeInput) (*route53.GetChangeOutput, error)
+}
+
+var (
+	errNoRecord          = errors.New("master record does not exist")
+	errTooManyRecords    = errors.New("expected only 1 value in master record")
+	errChangeSyncTimeout = errors.New("timed out waiting for route53 change to reach INSYNC")
+)
+
+// Route53MasterController implements the MasterController interface using a
+// Route53 record as the source of truth. For A records, the value is the
+// private ip address of the master's ec2 instance. For CNAME records, the
+// value is the master's private dns name.
+type Route53MasterController struct {
+	// The ID of the hosted zone that contains the record.
+	HostedZoneID string
+
+	// The name of the record (e.g. rabbitmq-master.internal).
+	RecordName string
+
+	// The type of the record, either "A" or "CNAME". The default is "A".
+	RecordType string
+
+	// The TTL to set on the record, in seconds. The default is
+	// DefaultRecordTTL.
+	TTL int64
+
+	// The maximum amount of time to wait for a change to reach INSYNC. The
+	// default is DefaultChangeTimeout.
+	Timeout time.Duration
+
+	route53 route53Client
+	ec2     ec2Client
+
+	// The amount of time to wait between checking the status of a change.
+	pollInterval time.Duration
+}
+
+func NewRoute53MasterController(hostedZoneID, recordName string) *Route53MasterController {
+	s := session.New()
+	return &Route53MasterController{
+		HostedZoneID: hostedZoneID,
+		RecordName:   recordName,
+		RecordType:   route53.RRTypeA,
+		TTL:          DefaultRecordTTL,
+		Timeout:      DefaultChangeTimeout,
+		route53:      route53.New(s),
+		ec2:          ec2.New(s),
+		pollInterval: 5 * time.Second,
+	}
+}
+
+// Master returns the node name of the current master.
+func (c *Route53MasterController) Master() (string, error) {
+	value, err := c.Value()
+	if err != nil {
+		return "", err
+	}
+
+	var hostname string
+	switch c.recordType() {
+	case route53.RRTypeA:
+		hostname, err = ipHostname(c.ec2, value)
+		if err != nil {
+			return "", err
+		}
+	case route53.RRTypeCname:
+		hostname = strings.TrimSuffix(value, ".")
+	default:
+		return "", unsupportedRecordType(c.recordType())
+	}
+
+	return fmt.Sprintf("rabbit@%s", hostname), nil
+}
+
+// Value returns the value of the master record.
+func (c *Route53MasterController) Value() (string, error) {
+	resp, err := c.route53.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(c.HostedZoneID),
+		StartRecordName: aws.String(c.RecordName),
+		StartRecordType: aws.String(c.recordType()),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// The listing starts at the record, but will include the next record
+	// if it doesn't exist.
+	if len(resp.ResourceRecordSets) == 0 {
+		return "", errNoRecord
+	}
+
+	set := resp.ResourceRecordSets[0]
+	if !sameRecordName(aws.StringValue(set.Name), c.RecordName) || aws.StringValue(set.Type) != c.recordType() {
+		return "", errNoRecord
+	}
+
+	// There should always be 1 value in the record.
+	if len(set.ResourceRecords) == 0 {
+		return "", errNoRecord
+	}
+
+	// There should be AT MOST 1 value in the record.
+	if len(set.ResourceRecords) > 1 {
+		return "", errTooManyRecords
+	}
+
+	return aws.StringValue(set.ResourceRecords[0].Value), nil
+}
+
+// SetMaster sets the node to be the new master.
+func (c *Route53MasterController) SetMaster(node string) error {
+	hostname, err := nodeHost(node)
+	if err != nil {
+		return err
+	}
+
+	var value string
+	switch c.recordType() {
+	case route53.RRTypeA:
+		value, err = hostnameIP(c.ec2, hostname)
+		if err != nil {
+			return err
+		}
+	case route53.RRTypeCname:
+		value = hostname
+	default:
+		return unsupportedRecordType(c.recordType())
+	}
+
+	return c.SetValue(value)
+}
+
+// SetValue UPSERTs the master record with the given value, then waits for the
+// change to reach INSYNC.
+func (c *Route53MasterController) SetValue(value string) error {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultRecordTTL
+	}
+
+	resp, err := c.route53.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(c.HostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("rabbitmq-clusterctl: set master"),
+			Changes: []*route53.Change{
+				{
+					Action: aws.String(route53.ChangeActionUpsert),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String(c.RecordName),
+						Type: aws.String(c.recordType()),
+						TTL:  aws.Int64(ttl),
+						ResourceRecords: []*route53.ResourceRecord{
+							{Value: aws.String(value)},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.waitInsync(resp.ChangeInfo)
+}
+
+// waitInsync waits until the change has propagated to all Route53 name
+// servers.
+func (c *Route53MasterController) waitInsync(change *route53.ChangeInfo) error {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultChangeTimeout
+	}
+
+	deadline := time.After(timeout)
+	for aws.StringValue(change.Status) != route53.ChangeStatusInsync {
+		select {
+		case <-deadline:
+			return errChangeSyncTimeout
+		case <-time.After(c.pollInterval):
+		}
+
+		resp, err := c.route53.GetChange(&route53.GetChangeInput{
+			Id: change.Id,
+		})
+		if err != nil {
+			return err
+		}
+		change = resp.ChangeInfo
+	}
+
+	return nil
+}
+
+// dryRun implements the dryRunner interface.
+func (c *Route53MasterController) dryRun(plan *Plan) {
+	c.route53 = &recordingRoute53Client{route53Client: c.route53, plan: plan}
+}
+
+// recordingRoute53Client is a route53Client that records changes to records in
+// a Plan, instead of making them. Recorded changes are reported as INSYNC.
+type recordingRoute53Client struct {
+	route53Client
+	plan *Plan
+}
+
+func (c *recordingRoute53Client) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	for _, change := range input.ChangeBatch.Changes {
+		set := change.ResourceRecordSet
+
+		var values []string
+		for _, record := range set.ResourceRecords {
+			values = append(values, aws.StringValue(record.Value))
+		}
+
+		c.plan.Record("route53", "ChangeResourceRecordSets %s %s %s %s %s ttl=%d", aws.StringValue(input.HostedZoneId), aws.StringValue(change.Action), aws.StringValue(set.Name), aws.StringValue(set.Type), strings.Join(values, ","), aws.Int64Value(set.TTL))
+	}
+
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{
+			Status: aws.String(route53.ChangeStatusInsync),
+		},
+	}, nil
+}
+
+func (c *Route53MasterController) recordType() string {
+	if c.RecordType == "" {
+		return route53.RRTypeA
+	}
+	return c.RecordType
+}
+
+// sameRecordName returns true if the two record names are the same, ignoring
+// case and the trailing dot that Route53 returns.
+func sameRecordName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+func unsupportedRecordType(recordType string) error {
+	return fmt.Errorf("unsupported record type %q, must be %q or %q", recordType, route53.RRTypeA, route53.RRTypeCname)
+}
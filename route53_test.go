@@ -0,0 +1,257 @@
+package clusterctl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRoute53MasterController_Master(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	ec2Client := new(mockEC2Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		route53:      route53Client,
+		ec2:          ec2Client,
+	}
+
+	route53Client.On("ListResourceRecordSets", listMasterRecordInput("A")).Return(masterRecord("A", "10.0.0.1"), nil)
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("private-ip-address"),
+				Values: []*string{aws.String("10.0.0.1")},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-10-0-0-1.ec2.internal", node)
+
+	route53Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestRoute53MasterController_Master_CNAME(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		RecordType:   "CNAME",
+		route53:      route53Client,
+	}
+
+	route53Client.On("ListResourceRecordSets", listMasterRecordInput("CNAME")).Return(masterRecord("CNAME", "ip-10-0-0-1.ec2.internal."), nil)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-10-0-0-1.ec2.internal", node)
+
+	route53Client.AssertExpectations(t)
+}
+
+func TestRoute53MasterController_Master_NoRecord(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		route53:      route53Client,
+	}
+
+	// The listing starts at the next record when the record doesn't exist.
+	next := masterRecord("A", "10.0.0.1")
+	next.ResourceRecordSets[0].Name = aws.String("rabbitmq-other.internal.")
+	route53Client.On("ListResourceRecordSets", listMasterRecordInput("A")).Return(next, nil)
+
+	_, err := c.Master()
+	assert.Equal(t, errNoRecord, err)
+
+	route53Client.AssertExpectations(t)
+}
+
+func TestRoute53MasterController_Master_TooManyRecords(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		route53:      route53Client,
+	}
+
+	records := masterRecord("A", "10.0.0.1")
+	records.ResourceRecordSets[0].ResourceRecords = append(records.ResourceRecordSets[0].ResourceRecords, &route53.ResourceRecord{Value: aws.String("10.0.0.2")})
+	route53Client.On("ListResourceRecordSets", listMasterRecordInput("A")).Return(records, nil)
+
+	_, err := c.Master()
+	assert.Equal(t, errTooManyRecords, err)
+
+	route53Client.AssertExpectations(t)
+}
+
+func TestRoute53MasterController_SetMaster(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	ec2Client := new(mockEC2Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		TTL:          5,
+		route53:      route53Client,
+		ec2:          ec2Client,
+		pollInterval: time.Millisecond,
+	}
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("private-dns-name"),
+				Values: []*string{aws.String("ip-10-0-0-2.ec2.internal")},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						PrivateIpAddress: aws.String("10.0.0.2"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	route53Client.On("ChangeResourceRecordSets", upsertMasterRecordInput("A", "10.0.0.2", 5)).Return(&route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: changeInfo(route53.ChangeStatusPending),
+	}, nil)
+
+	route53Client.On("GetChange", &route53.GetChangeInput{
+		Id: aws.String("C123"),
+	}).Return(&route53.GetChangeOutput{
+		ChangeInfo: changeInfo(route53.ChangeStatusPending),
+	}, nil).Once()
+	route53Client.On("GetChange", &route53.GetChangeInput{
+		Id: aws.String("C123"),
+	}).Return(&route53.GetChangeOutput{
+		ChangeInfo: changeInfo(route53.ChangeStatusInsync),
+	}, nil).Once()
+
+	err := c.SetMaster("rabbit@ip-10-0-0-2.ec2.internal")
+	assert.NoError(t, err)
+
+	route53Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestRoute53MasterController_SetMaster_Timeout(t *testing.T) {
+	route53Client := new(mockRoute53Client)
+	c := &Route53MasterController{
+		HostedZoneID: "Z123",
+		RecordName:   "rabbitmq-master.internal",
+		RecordType:   "CNAME",
+		Timeout:      10 * time.Millisecond,
+		route53:      route53Client,
+		pollInterval: time.Millisecond,
+	}
+
+	route53Client.On("ChangeResourceRecordSets", upsertMasterRecordInput("CNAME", "ip-10-0-0-2.ec2.internal", DefaultRecordTTL)).Return(&route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: changeInfo(route53.ChangeStatusPending),
+	}, nil)
+
+	route53Client.On("GetChange", &route53.GetChangeInput{
+		Id: aws.String("C123"),
+	}).Return(&route53.GetChangeOutput{
+		ChangeInfo: changeInfo(route53.ChangeStatusPending),
+	}, nil)
+
+	err := c.SetMaster("rabbit@ip-10-0-0-2.ec2.internal")
+	assert.Equal(t, errChangeSyncTimeout, err)
+
+	route53Client.AssertExpectations(t)
+}
+
+func listMasterRecordInput(recordType string) *route53.ListResourceRecordSetsInput {
+	return &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String("Z123"),
+		StartRecordName: aws.String("rabbitmq-master.internal"),
+		StartRecordType: aws.String(recordType),
+		MaxItems:        aws.String("1"),
+	}
+}
+
+func masterRecord(recordType, value string) *route53.ListResourceRecordSetsOutput {
+	return &route53.ListResourceRecordSetsOutput{
+		ResourceRecordSets: []*route53.ResourceRecordSet{
+			{
+				Name: aws.String("rabbitmq-master.internal."),
+				Type: aws.String(recordType),
+				ResourceRecords: []*route53.ResourceRecord{
+					{Value: aws.String(value)},
+				},
+			},
+		},
+	}
+}
+
+func upsertMasterRecordInput(recordType, value string, ttl int64) *route53.ChangeResourceRecordSetsInput {
+	return &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String("Z123"),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("rabbitmq-clusterctl: set master"),
+			Changes: []*route53.Change{
+				{
+					Action: aws.String("UPSERT"),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String("rabbitmq-master.internal"),
+						Type: aws.String(recordType),
+						TTL:  aws.Int64(ttl),
+						ResourceRecords: []*route53.ResourceRecord{
+							{Value: aws.String(value)},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func changeInfo(status string) *route53.ChangeInfo {
+	return &route53.ChangeInfo{
+		Id:     aws.String("C123"),
+		Status: aws.String(status),
+	}
+}
+
+type mockRoute53Client struct {
+	mock.Mock
+}
+
+func (m *mockRoute53Client) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*route53.ListResourceRecordSetsOutput), args.Error(1)
+}
+
+func (m *mockRoute53Client) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*route53.ChangeResourceRecordSetsOutput), args.Error(1)
+}
+
+func (m *mockRoute53Client) GetChange(input *route53.GetChangeInput) (*route53.GetChangeOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*route53.GetChangeOutput), args.Error(1)
+}
@@ -0,0 +1,202 @@
+package clusterctl
+
+import (
+	"fmt"
+	"sort"
+)
+
+// QueueStatus is the replication state of a mirrored classic queue, or a quorum
+// queue.
+type QueueStatus struct {
+	VHost string `json:"vhost" yaml:"vhost"`
+	Name  string `json:"name" yaml:"name"`
+
+	// The node that hosts the queue master, or leader.
+	Node string `json:"node" yaml:"node"`
+
+	// The mirrors, or members, of the queue that are not synchronised with
+	// the master, or are offline.
+	Unsynchronised []string `json:"unsynchronised" yaml:"unsynchronised"`
+}
+
+// MasterHealth is the health of the master, as reported by the master backend
+// (e.g. the ELB instance health).
+type MasterHealth struct {
+	// Whether the backend considers the master to be healthy.
+	Healthy bool `json:"healthy" yaml:"healthy"`
+
+	// The backend specific state (e.g. "InService") and a description of
+	// it.
+	State       string `json:"state" yaml:"state"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// MasterHealthChecker is implemented by MasterControllers that can report the
+// health of the master.
+type MasterHealthChecker interface {
+	MasterHealth() (*MasterHealth, error)
+}
+
+// QueueStatusController is implemented by MembershipControllers that can report
+// the replication state of queues.
+type QueueStatusController interface {
+	// QueueStatus returns the replication state of all queues, as seen
+	// from the given node.
+	QueueStatus(node string) ([]QueueStatus, error)
+}
+
+// Status is a report of the state of the cluster and the master.
+type Status struct {
+	// The node that the status was taken from.
+	Node string `json:"node" yaml:"node"`
+
+	// The current master, and the error if it couldn't be determined. The
+	// error is also recorded as a problem.
+	Master      string `json:"master" yaml:"master"`
+	MasterError error  `json:"-" yaml:"-"`
+
+	// The health of the master according to the master backend, if the
+	// backend supports it.
+	MasterHealth *MasterHealth `json:"master_health,omitempty" yaml:"master_health,omitempty"`
+
+	// The status of the cluster.
+	Cluster *ClusterStatus `json:"cluster" yaml:"cluster"`
+
+	// Queues that have unsynchronised mirrors or offline members.
+	UnsynchronisedQueues []QueueStatus `json:"unsynchronised_queues" yaml:"unsynchronised_queues"`
+
+	// Problems that were detected.
+	Problems []string `json:"problems" yaml:"problems"`
+}
+
+// Healthy returns true if no problems were detected.
+func (s *Status) Healthy() bool {
+	return len(s.Problems) == 0
+}
+
+// Status returns a report of the state of the cluster, as seen from the current
+// node, and the master. Problems, like the master not being a running member of
+// the cluster, are recorded in the report rather than returned as errors. An
+// error is only returned if the cluster status can't be determined at all.
+func (c *Controller) Status() (*Status, error) {
+	status, ok := c.MembershipController.(StatusController)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support reporting status", c.MembershipController)
+	}
+
+	s := &Status{Node: c.Node}
+
+	cluster, err := status.ClusterStatus(c.Node)
+	if err != nil {
+		return nil, err
+	}
+	s.Cluster = cluster
+
+	s.Master, s.MasterError = c.Master()
+	if s.MasterError != nil {
+		s.problemf("unable to determine the master: %v", s.MasterError)
+	} else {
+		if !cluster.IsMember(s.Master) {
+			s.problemf("master %s is not a member of the cluster", s.Master)
+		} else if !cluster.IsRunning(s.Master) {
+			s.problemf("master %s is not running", s.Master)
+		}
+	}
+
+	if checker, ok := unwrapMaster(c.MasterController).(MasterHealthChecker); ok && s.MasterError == nil {
+		health, err := checker.MasterHealth()
+		if err != nil {
+			s.problemf("unable to determine the health of master %s: %v", s.Master, err)
+		} else {
+			s.MasterHealth = health
+			if !health.Healthy {
+				s.problemf("master %s is unhealthy: %s: %s", s.Master, health.State, health.Description)
+			}
+		}
+	}
+
+	for _, node := range cluster.Nodes() {
+		if !cluster.IsRunning(node) {
+			s.problemf("node %s is not running", node)
+		}
+	}
+
+	var partitioned []string
+	for node, nodes := range cluster.Partitions {
+		if len(nodes) > 0 {
+			partitioned = append(partitioned, node)
+		}
+	}
+	sort.Strings(partitioned)
+	for _, node := range partitioned {
+		s.problemf("node %s is partitioned from %v", node, cluster.Partitions[node])
+	}
+
+	for _, alarm := range cluster.Alarms {
+		s.problemf("%s alarm on node %s", alarm.Resource, alarm.Node)
+	}
+
+	if queueStatus, ok := c.MembershipController.(QueueStatusController); ok {
+		queues, err := queueStatus.QueueStatus(c.Node)
+		if err != nil {
+			s.problemf("unable to list queues: %v", err)
+		}
+		for _, q := range queues {
+			if len(q.Unsynchronised) > 0 {
+				s.UnsynchronisedQueues = append(s.UnsynchronisedQueues, q)
+				s.problemf("queue %s in vhost %s has unsynchronised replicas on %v", q.Name, q.VHost, q.Unsynchronised)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Status) problemf(format string, args ...interface{}) {
+	s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+}
+
+// QueueStatus returns the replication state of all queues, as seen from the
+// given node.
+func (c *RabbitmqCtlMembershipController) QueueStatus(node string) ([]QueueStatus, error) {
+	queues, err := listQueues(c.rabbitmqctl, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []QueueStatus
+	for _, q := range queues {
+		s := QueueStatus{VHost: q.VHost, Name: q.Name, Node: q.Node}
+
+		if q.Quorum() {
+			for _, member := range q.Members {
+				if !contains(q.OnlineNodes, member) {
+					s.Unsynchronised = append(s.Unsynchronised, member)
+				}
+			}
+		} else {
+			for _, slave := range q.SlaveNodes {
+				if q.Unsynchronised(slave) {
+					s.Unsynchronised = append(s.Unsynchronised, slave)
+				}
+			}
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
+
+// unwrapMaster returns the MasterController that's wrapped by any middleware.
+func unwrapMaster(m MasterController) MasterController {
+	for {
+		u, ok := m.(interface {
+			Unwrap() MasterController
+		})
+		if !ok {
+			return m
+		}
+		m = u.Unwrap()
+	}
+}
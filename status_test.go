@@ -0,0 +1,132 @@
+package clusterctl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestController_Status(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("rabbit@master", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[<rabbit@slave.1.2.3>]\tclassic\t\t\n"+
+			"orders\t<rabbit@master.1.2.3>\t\t\tquorum\t[rabbit@master, rabbit@slave]\t[rabbit@master, rabbit@slave]\n", nil)
+
+	s, err := c.Status()
+	assert.NoError(t, err)
+	assert.True(t, s.Healthy())
+	assert.Equal(t, "rabbit@master", s.Master)
+	assert.Equal(t, []string{"rabbit@master", "rabbit@slave"}, s.Cluster.RunningNodes)
+	assert.Nil(t, s.UnsynchronisedQueues)
+
+	m.AssertExpectations(t)
+}
+
+func TestController_Status_Problems(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := &mockHealthMasterController{
+		health: &MasterHealth{Healthy: false, State: "OutOfService", Description: "Instance has failed at least the UnhealthyThreshold number of health checks consecutively."},
+	}
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     SyncQueues(master, DefaultRabbitmqCtl),
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("rabbit@master", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(
+		`{"alarms":[{"node":"rabbit@slave","resource":"disk","type":"resource_limit"}],"cluster_name":"rabbit@master","disk_nodes":["rabbit@master","rabbit@slave"],"partitions":{"rabbit@slave":["rabbit@master"]},"ram_nodes":[],"running_nodes":["rabbit@slave"]}`, nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_queues", listQueuesArgs("/")).Return(
+		"events\t<rabbit@master.1.2.3>\t[<rabbit@slave.1.2.3>]\t[]\tclassic\t\t\n"+
+			"orders\t<rabbit@slave.1.2.3>\t\t\tquorum\t[rabbit@master, rabbit@slave]\t[rabbit@slave]\n", nil)
+
+	s, err := c.Status()
+	assert.NoError(t, err)
+	assert.False(t, s.Healthy())
+	assert.Equal(t, []QueueStatus{
+		{VHost: "/", Name: "events", Node: "rabbit@master", Unsynchronised: []string{"rabbit@slave"}},
+		{VHost: "/", Name: "orders", Node: "rabbit@slave", Unsynchronised: []string{"rabbit@master"}},
+	}, s.UnsynchronisedQueues)
+	assert.Equal(t, []string{
+		"master rabbit@master is not running",
+		"master rabbit@master is unhealthy: OutOfService: Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+		"node rabbit@master is not running",
+		"node rabbit@slave is partitioned from [rabbit@master]",
+		"disk alarm on node rabbit@slave",
+		"queue events in vhost / has unsynchronised replicas on [rabbit@slave]",
+		"queue orders in vhost / has unsynchronised replicas on [rabbit@master]",
+	}, s.Problems)
+
+	m.AssertExpectations(t)
+}
+
+func TestController_Status_NotMember(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:                 "rabbit@slave",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}
+
+	master.On("Master").Return("rabbit@other", nil)
+	m.On("rabbitmqctl", "rabbit@slave", "cluster_status", clusterStatusArgs).Return(clusterStatusOutput("rabbit@master", "rabbit@slave"), nil)
+	m.On("rabbitmqctl", "rabbit@slave", "list_vhosts", []string{"-q", "name"}).Return("", nil)
+
+	s, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"master rabbit@other is not a member of the cluster"}, s.Problems)
+}
+
+func TestController_Status_NoQueueStatus(t *testing.T) {
+	master := new(mockMasterController)
+	c := &Controller{
+		Node:             "rabbit@slave",
+		MasterController: master,
+		MembershipController: &mockStatusMembershipController{
+			status: &ClusterStatus{DiscNodes: []string{"rabbit@master", "rabbit@slave"}, RunningNodes: []string{"rabbit@master", "rabbit@slave"}},
+		},
+	}
+
+	master.On("Master").Return("rabbit@master", nil)
+
+	// Queues aren't checked if the MembershipController doesn't implement
+	// QueueStatusController.
+	s, err := c.Status()
+	assert.NoError(t, err)
+	assert.True(t, s.Healthy())
+	assert.Nil(t, s.UnsynchronisedQueues)
+}
+
+// mockStatusMembershipController is a mockMembershipController that implements
+// StatusController, but not QueueStatusController.
+type mockStatusMembershipController struct {
+	mockMembershipController
+	status *ClusterStatus
+}
+
+func (m *mockStatusMembershipController) ClusterStatus(node string) (*ClusterStatus, error) {
+	return m.status, nil
+}
+
+// mockHealthMasterController is a mockMasterController that also reports the
+// health of the master.
+type mockHealthMasterController struct {
+	mockMasterController
+	health *MasterHealth
+}
+
+func (m *mockHealthMasterController) MasterHealth() (*MasterHealth, error) {
+	return m.health, nil
+}
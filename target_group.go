@@ -0,0 +1,386 @@
+package clusterctl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+type elbv2Client interface {
+	DescribeTargetGroups(*elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error)
+	DescribeTargetHealth(*elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error)
+	RegisterTargets(*elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error)
+	DeregisterTargets(*elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error)
+}
+
+func init() {
+	RegisterMaster("elbv2", func(u *MasterURL) (MasterController, error) {
+		m := NewTargetGroupMasterController(u.Target)
+		m.TargetType = u.Get("target_type")
+
+		timeout, err := u.Duration("health_timeout", DefaultHealthTimeout)
+		if err != nil {
+			return nil, err
+		}
+		m.HealthTimeout = timeout
+
+		return m, nil
+	})
+}
+
+var errNoTargetGroup = errors.New("target group does not exist")
+
+// TargetGroupMasterController implements the MasterController interface using
+// an elbv2 target group (as used by Application and Network Load Balancers) as
+// the source of truth. Both instance and ip target types are supported.
+type TargetGroupMasterController struct {
+	// The ARN of the target group to use.
+	TargetGroupARN string
+
+	// The target type of the target group ("instance" or "ip"). If empty,
+	// it's looked up from the target group.
+	TargetType string
+
+	// The maximum amount of time to wait for a new master to become
+	// healthy. The default is DefaultHealthTimeout.
+	HealthTimeout time.Duration
+
+	elbv2 elbv2Client
+	ec2   ec2Client
+
+	// The amount of time to wait between checking target health.
+	pollInterval time.Duration
+}
+
+func NewTargetGroupMasterController(targetGroupARN string) *TargetGroupMasterController {
+	s := session.New()
+	return &TargetGroupMasterController{
+		TargetGroupARN: targetGroupARN,
+		HealthTimeout:  DefaultHealthTimeout,
+		elbv2:          elbv2.New(s),
+		ec2:            ec2.New(s),
+		pollInterval:   5 * time.Second,
+	}
+}
+
+// TargetNotHealthyError is returned when a new master does not become healthy
+// in the target group before the timeout.
+type TargetNotHealthyError struct {
+	TargetID    string
+	State       string
+	Description string
+}
+
+// Error implements the error interface.
+func (e *TargetNotHealthyError) Error() string {
+	return fmt.Sprintf("target %s did not become healthy: %s: %s", e.TargetID, e.State, e.Description)
+}
+
+// Master returns the node name of the current master.
+func (c *TargetGroupMasterController) Master() (string, error) {
+	target, err := c.Target()
+	if err != nil {
+		return "", err
+	}
+
+	targetType, err := c.targetType()
+	if err != nil {
+		return "", err
+	}
+
+	var hostname string
+	switch targetType {
+	case elbv2.TargetTypeEnumInstance:
+		hostname, err = instanceHostname(c.ec2, *target.Id)
+	case elbv2.TargetTypeEnumIp:
+		hostname, err = ipHostname(c.ec2, *target.Id)
+	default:
+		err = unsupportedTargetType(targetType)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("rabbit@%s", hostname), nil
+}
+
+// Target returns the target that is the current master.
+func (c *TargetGroupMasterController) Target() (*elbv2.TargetDescription, error) {
+	targets, err := c.targets()
+	if err != nil {
+		return nil, err
+	}
+
+	// There should always be 1 target registered with the target group.
+	if len(targets) == 0 {
+		return nil, errNoInstances
+	}
+
+	// There should be AT MOST 1 target registered with the target group.
+	if len(targets) > 1 {
+		return nil, errTooManyInstances
+	}
+
+	return targets[0], nil
+}
+
+// MasterHealth returns the health of the master target, as reported by the
+// target group.
+func (c *TargetGroupMasterController) MasterHealth() (*MasterHealth, error) {
+	target, err := c.Target()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.elbv2.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(c.TargetGroupARN),
+		Targets:        []*elbv2.TargetDescription{target},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.TargetHealthDescriptions) == 0 || resp.TargetHealthDescriptions[0].TargetHealth == nil {
+		return nil, errNoInstances
+	}
+
+	health := resp.TargetHealthDescriptions[0].TargetHealth
+	return &MasterHealth{
+		Healthy:     aws.StringValue(health.State) == elbv2.TargetHealthStateEnumHealthy,
+		State:       aws.StringValue(health.State),
+		Description: aws.StringValue(health.Description),
+	}, nil
+}
+
+// targets returns the targets that are registered with the target group.
+// Targets that are draining are excluded, since they're in the process of
+// being deregistered.
+func (c *TargetGroupMasterController) targets() ([]*elbv2.TargetDescription, error) {
+	resp, err := c.elbv2.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(c.TargetGroupARN),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*elbv2.TargetDescription
+	for _, d := range resp.TargetHealthDescriptions {
+		if d.TargetHealth != nil && aws.StringValue(d.TargetHealth.State) == elbv2.TargetHealthStateEnumDraining {
+			continue
+		}
+		targets = append(targets, d.Target)
+	}
+
+	return targets, nil
+}
+
+// SetMaster sets the node to be the new master.
+func (c *TargetGroupMasterController) SetMaster(node string) error {
+	hostname, err := nodeHost(node)
+	if err != nil {
+		return err
+	}
+
+	targetType, err := c.targetType()
+	if err != nil {
+		return err
+	}
+
+	var id string
+	switch targetType {
+	case elbv2.TargetTypeEnumInstance:
+		id, err = instanceWithHostname(c.ec2, hostname)
+	case elbv2.TargetTypeEnumIp:
+		id, err = hostnameIP(c.ec2, hostname)
+	default:
+		err = unsupportedTargetType(targetType)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.SetTarget(id)
+}
+
+// SetTarget makes the given target (an instance id or ip address, depending on
+// the target type) the only target in the target group. The target is
+// registered first, and the other targets are only deregistered once it's
+// healthy, so that there's always a target to route to. If the target doesn't
+// become healthy within the HealthTimeout, it's deregistered again, leaving
+// the old targets in place.
+func (c *TargetGroupMasterController) SetTarget(id string) error {
+	targets, err := c.targets()
+	if err != nil {
+		return err
+	}
+
+	var (
+		old        []*elbv2.TargetDescription
+		registered bool
+	)
+	for _, target := range targets {
+		if aws.StringValue(target.Id) == id {
+			registered = true
+			continue
+		}
+		old = append(old, target)
+	}
+
+	target := []*elbv2.TargetDescription{{Id: aws.String(id)}}
+
+	if !registered {
+		if _, err := c.elbv2.RegisterTargets(&elbv2.RegisterTargetsInput{
+			TargetGroupArn: aws.String(c.TargetGroupARN),
+			Targets:        target,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := c.waitHealthy(id); err != nil {
+		if !registered {
+			if rollbackErr := c.deregister(target); rollbackErr != nil {
+				return &RollbackError{Err: err, RollbackErr: rollbackErr}
+			}
+		}
+		return err
+	}
+
+	return c.deregister(old)
+}
+
+// deregister removes the targets from the target group.
+func (c *TargetGroupMasterController) deregister(targets []*elbv2.TargetDescription) error {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	_, err := c.elbv2.DeregisterTargets(&elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(c.TargetGroupARN),
+		Targets:        targets,
+	})
+
+	return err
+}
+
+// waitHealthy waits until the target is healthy in the target group.
+func (c *TargetGroupMasterController) waitHealthy(id string) error {
+	timeout := c.HealthTimeout
+	if timeout == 0 {
+		timeout = DefaultHealthTimeout
+	}
+
+	deadline := time.After(timeout)
+	for {
+		resp, err := c.elbv2.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: aws.String(c.TargetGroupARN),
+			Targets:        []*elbv2.TargetDescription{{Id: aws.String(id)}},
+		})
+		if err != nil {
+			return err
+		}
+
+		notHealthy := &TargetNotHealthyError{TargetID: id}
+		for _, d := range resp.TargetHealthDescriptions {
+			if d.TargetHealth == nil {
+				continue
+			}
+			if aws.StringValue(d.TargetHealth.State) == elbv2.TargetHealthStateEnumHealthy {
+				return nil
+			}
+			notHealthy.State = aws.StringValue(d.TargetHealth.State)
+			notHealthy.Description = aws.StringValue(d.TargetHealth.Description)
+		}
+
+		select {
+		case <-deadline:
+			return notHealthy
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// dryRun implements the dryRunner interface.
+func (c *TargetGroupMasterController) dryRun(plan *Plan) {
+	c.elbv2 = &recordingELBV2Client{elbv2Client: c.elbv2, plan: plan, registered: make(map[string]bool)}
+}
+
+// recordingELBV2Client is an elbv2Client that records changes to target groups
+// in a Plan, instead of making them. Targets that are registered are reported
+// as healthy, so that waiting for them completes.
+type recordingELBV2Client struct {
+	elbv2Client
+	plan *Plan
+
+	registered map[string]bool
+}
+
+func (c *recordingELBV2Client) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	for _, target := range input.Targets {
+		c.registered[aws.StringValue(target.Id)] = true
+	}
+
+	c.plan.Record("elbv2", "RegisterTargets %s %s", aws.StringValue(input.TargetGroupArn), strings.Join(targetIDs(input.Targets), ","))
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (c *recordingELBV2Client) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	c.plan.Record("elbv2", "DeregisterTargets %s %s", aws.StringValue(input.TargetGroupArn), strings.Join(targetIDs(input.Targets), ","))
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (c *recordingELBV2Client) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	if len(input.Targets) == 1 && c.registered[aws.StringValue(input.Targets[0].Id)] {
+		return &elbv2.DescribeTargetHealthOutput{
+			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+				{
+					Target:       input.Targets[0],
+					TargetHealth: &elbv2.TargetHealth{State: aws.String(elbv2.TargetHealthStateEnumHealthy)},
+				},
+			},
+		}, nil
+	}
+
+	return c.elbv2Client.DescribeTargetHealth(input)
+}
+
+// targetIDs returns the ids of the targets.
+func targetIDs(targets []*elbv2.TargetDescription) []string {
+	var ids []string
+	for _, target := range targets {
+		ids = append(ids, aws.StringValue(target.Id))
+	}
+	return ids
+}
+
+// targetType returns the target type of the target group, looking it up if it
+// wasn't provided.
+func (c *TargetGroupMasterController) targetType() (string, error) {
+	if c.TargetType != "" {
+		return c.TargetType, nil
+	}
+
+	resp, err := c.elbv2.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{aws.String(c.TargetGroupARN)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.TargetGroups) == 0 {
+		return "", errNoTargetGroup
+	}
+
+	c.TargetType = aws.StringValue(resp.TargetGroups[0].TargetType)
+	return c.TargetType, nil
+}
+
+func unsupportedTargetType(targetType string) error {
+	return fmt.Errorf("unsupported target type %q, must be %q or %q", targetType, elbv2.TargetTypeEnumInstance, elbv2.TargetTypeEnumIp)
+}
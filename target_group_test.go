@@ -0,0 +1,383 @@
+package clusterctl
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testTargetGroupARN = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/rabbitmq/abcdef"
+
+func TestTargetGroupMasterController_Master(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	ec2Client := new(mockEC2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		elbv2:          elbv2Client,
+		ec2:            ec2Client,
+	}
+
+	elbv2Client.On("DescribeTargetGroups", &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{aws.String(testTargetGroupARN)},
+	}).Return(&elbv2.DescribeTargetGroupsOutput{
+		TargetGroups: []*elbv2.TargetGroup{
+			{TargetType: aws.String(elbv2.TargetTypeEnumInstance)},
+		},
+	}, nil)
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String("i-1234")},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						PrivateDnsName: aws.String("ip-1-2-3-4.ec2.internal"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-1-2-3-4.ec2.internal", node)
+
+	elbv2Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_Master_IP(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	ec2Client := new(mockEC2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		TargetType:     elbv2.TargetTypeEnumIp,
+		elbv2:          elbv2Client,
+		ec2:            ec2Client,
+	}
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("10.0.0.1", elbv2.TargetHealthStateEnumDraining),
+			targetHealth("10.0.0.2", elbv2.TargetHealthStateEnumInitial),
+		},
+	}, nil)
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("private-ip-address"),
+				Values: []*string{aws.String("10.0.0.2")},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						PrivateDnsName: aws.String("ip-10-0-0-2.ec2.internal"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	node, err := c.Master()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@ip-10-0-0-2.ec2.internal", node)
+
+	elbv2Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_Master_NoInstances(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		TargetType:     elbv2.TargetTypeEnumInstance,
+		elbv2:          elbv2Client,
+	}
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{}, nil)
+
+	_, err := c.Master()
+	assert.Equal(t, errNoInstances, err)
+
+	elbv2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_Master_TooManyInstances(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		TargetType:     elbv2.TargetTypeEnumInstance,
+		elbv2:          elbv2Client,
+	}
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumHealthy),
+			targetHealth("i-4321", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+
+	_, err := c.Master()
+	assert.Equal(t, errTooManyInstances, err)
+
+	elbv2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_SetMaster(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	ec2Client := new(mockEC2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		TargetType:     elbv2.TargetTypeEnumInstance,
+		elbv2:          elbv2Client,
+		ec2:            ec2Client,
+	}
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("private-dns-name"),
+				Values: []*string{aws.String("ip-1-2-3-4.ec2.internal")},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						InstanceId: aws.String("i-1234"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-4321", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+
+	// The new master is registered, and the old one only deregistered
+	// once the new one is healthy.
+	elbv2Client.On("RegisterTargets", &elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+		Targets: []*elbv2.TargetDescription{
+			{Id: aws.String("i-1234")},
+		},
+	}).Return(&elbv2.RegisterTargetsOutput{}, nil)
+
+	elbv2Client.On("DescribeTargetHealth", describeTargetHealthInput("i-1234")).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumInitial),
+		},
+	}, nil).Once()
+	elbv2Client.On("DescribeTargetHealth", describeTargetHealthInput("i-1234")).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil).Once()
+
+	elbv2Client.On("DeregisterTargets", &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+		Targets: []*elbv2.TargetDescription{
+			{Id: aws.String("i-4321")},
+		},
+	}).Return(&elbv2.DeregisterTargetsOutput{}, nil)
+
+	err := c.SetMaster("rabbit@ip-1-2-3-4.ec2.internal")
+	assert.NoError(t, err)
+
+	elbv2Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_SetMaster_IP(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	ec2Client := new(mockEC2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		TargetType:     elbv2.TargetTypeEnumIp,
+		elbv2:          elbv2Client,
+		ec2:            ec2Client,
+	}
+
+	ec2Client.On("DescribeInstances", &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("private-dns-name"),
+				Values: []*string{aws.String("ip-10-0-0-2.ec2.internal")},
+			},
+		},
+	}).Return(&ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				Instances: []*ec2.Instance{
+					{
+						PrivateIpAddress: aws.String("10.0.0.2"),
+					},
+				},
+			},
+		},
+	}, nil)
+
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{}, nil)
+
+	elbv2Client.On("RegisterTargets", &elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+		Targets: []*elbv2.TargetDescription{
+			{Id: aws.String("10.0.0.2")},
+		},
+	}).Return(&elbv2.RegisterTargetsOutput{}, nil)
+
+	elbv2Client.On("DescribeTargetHealth", describeTargetHealthInput("10.0.0.2")).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("10.0.0.2", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+
+	err := c.SetMaster("rabbit@ip-10-0-0-2.ec2.internal")
+	assert.NoError(t, err)
+
+	elbv2Client.AssertExpectations(t)
+	ec2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_SetTarget_AlreadyRegistered(t *testing.T) {
+	elbv2Client := new(mockELBV2Client)
+	c := &TargetGroupMasterController{
+		TargetGroupARN: testTargetGroupARN,
+		elbv2:          elbv2Client,
+	}
+
+	// Promoting the current master again doesn't deregister it.
+	elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+	}).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+	elbv2Client.On("DescribeTargetHealth", describeTargetHealthInput("i-1234")).Return(&elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			targetHealth("i-1234", elbv2.TargetHealthStateEnumHealthy),
+		},
+	}, nil)
+
+	err := c.SetTarget("i-1234")
+	assert.NoError(t, err)
+
+	elbv2Client.AssertExpectations(t)
+}
+
+func TestTargetGroupMasterController_SetTarget_Rollback(t *testing.T) {
+	for _, rollbackErr := range []error{nil, errors.New("throttled")} {
+		elbv2Client := new(mockELBV2Client)
+		c := &TargetGroupMasterController{
+			TargetGroupARN: testTargetGroupARN,
+			HealthTimeout:  time.Millisecond,
+			elbv2:          elbv2Client,
+		}
+
+		elbv2Client.On("DescribeTargetHealth", &elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: aws.String(testTargetGroupARN),
+		}).Return(&elbv2.DescribeTargetHealthOutput{
+			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+				targetHealth("i-4321", elbv2.TargetHealthStateEnumHealthy),
+			},
+		}, nil)
+
+		elbv2Client.On("RegisterTargets", &elbv2.RegisterTargetsInput{
+			TargetGroupArn: aws.String(testTargetGroupARN),
+			Targets:        []*elbv2.TargetDescription{{Id: aws.String("i-1234")}},
+		}).Return(&elbv2.RegisterTargetsOutput{}, nil)
+
+		elbv2Client.On("DescribeTargetHealth", describeTargetHealthInput("i-1234")).Return(&elbv2.DescribeTargetHealthOutput{
+			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+				targetHealth("i-1234", elbv2.TargetHealthStateEnumUnhealthy),
+			},
+		}, nil)
+
+		// The new target is deregistered again, and the old one is left
+		// in place.
+		elbv2Client.On("DeregisterTargets", &elbv2.DeregisterTargetsInput{
+			TargetGroupArn: aws.String(testTargetGroupARN),
+			Targets:        []*elbv2.TargetDescription{{Id: aws.String("i-1234")}},
+		}).Return(&elbv2.DeregisterTargetsOutput{}, rollbackErr)
+
+		var err error = &TargetNotHealthyError{TargetID: "i-1234", State: elbv2.TargetHealthStateEnumUnhealthy}
+		if rollbackErr != nil {
+			err = &RollbackError{Err: err, RollbackErr: rollbackErr}
+		}
+		assert.Equal(t, err, c.SetTarget("i-1234"))
+
+		elbv2Client.AssertExpectations(t)
+	}
+}
+
+func describeTargetHealthInput(id string) *elbv2.DescribeTargetHealthInput {
+	return &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(testTargetGroupARN),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(id)}},
+	}
+}
+
+func targetHealth(id, state string) *elbv2.TargetHealthDescription {
+	return &elbv2.TargetHealthDescription{
+		Target:       &elbv2.TargetDescription{Id: aws.String(id)},
+		TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+	}
+}
+
+type mockELBV2Client struct {
+	mock.Mock
+}
+
+func (m *mockELBV2Client) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elbv2.DescribeTargetGroupsOutput), args.Error(1)
+}
+
+func (m *mockELBV2Client) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elbv2.DescribeTargetHealthOutput), args.Error(1)
+}
+
+func (m *mockELBV2Client) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elbv2.RegisterTargetsOutput), args.Error(1)
+}
+
+func (m *mockELBV2Client) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	args := m.Called(input)
+	return args.Get(0).(*elbv2.DeregisterTargetsOutput), args.Error(1)
+}
@@ -0,0 +1,232 @@
+package clusterctl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This file contains a minimal parser for the erlang terms that older versions
+// of rabbitmqctl print (e.g. the output of `rabbitmqctl cluster_status`). It
+// understands atoms, strings, binaries, numbers, lists and tuples, which is all
+// that's needed to parse rabbitmqctl's output.
+
+// atom represents an erlang atom.
+type atom string
+
+// tuple represents an erlang tuple.
+type tuple []interface{}
+
+// parseTerm parses a single erlang term. Trailing text, such as the "...done."
+// that older versions of rabbitmqctl print, is ignored.
+func parseTerm(s string) (interface{}, error) {
+	p := &termParser{s: s}
+	return p.parse()
+}
+
+type termParser struct {
+	s   string
+	pos int
+}
+
+func (p *termParser) parse() (interface{}, error) {
+	p.skipSpace()
+
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end of input")
+	}
+
+	switch c := p.s[p.pos]; {
+	case c == '[':
+		return p.parseSeq('[', ']')
+	case c == '{':
+		t, err := p.parseSeq('{', '}')
+		return tuple(t), err
+	case c == '"':
+		return p.parseQuoted('"')
+	case c == '\'':
+		s, err := p.parseQuoted('\'')
+		return atom(s), err
+	case strings.HasPrefix(p.s[p.pos:], "<<"):
+		return p.parseBinary()
+	case c == '-' || isDigit(c):
+		return p.parseNumber()
+	case isAtomChar(rune(c)):
+		return p.parseAtom(), nil
+	default:
+		return nil, p.errorf("unexpected character %q", c)
+	}
+}
+
+func (p *termParser) parseSeq(open, close byte) ([]interface{}, error) {
+	p.pos++ // open
+
+	terms := []interface{}{}
+	for {
+		p.skipSpace()
+
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated %q", open)
+		}
+
+		if p.s[p.pos] == close {
+			p.pos++
+			return terms, nil
+		}
+
+		if len(terms) > 0 {
+			if p.s[p.pos] != ',' {
+				return nil, p.errorf("expected ',' or %q", close)
+			}
+			p.pos++
+		}
+
+		term, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+}
+
+func (p *termParser) parseQuoted(quote byte) (string, error) {
+	p.pos++ // opening quote
+
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+
+		switch c {
+		case quote:
+			return b.String(), nil
+		case '\\':
+			if p.pos < len(p.s) {
+				b.WriteByte(p.s[p.pos])
+				p.pos++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", p.errorf("unterminated %c", quote)
+}
+
+func (p *termParser) parseBinary() (string, error) {
+	p.pos += 2 // <<
+
+	p.skipSpace()
+
+	var s string
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		var err error
+		s, err = p.parseQuoted('"')
+		if err != nil {
+			return "", err
+		}
+		p.skipSpace()
+	}
+
+	if !strings.HasPrefix(p.s[p.pos:], ">>") {
+		return "", p.errorf("unterminated binary")
+	}
+	p.pos += 2
+
+	return s, nil
+}
+
+func (p *termParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] == 'e') {
+		p.pos++
+	}
+
+	s := p.s[start:p.pos]
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", s)
+	}
+	return f, nil
+}
+
+func (p *termParser) parseAtom() atom {
+	start := p.pos
+	for p.pos < len(p.s) && isAtomChar(rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return atom(p.s[start:p.pos])
+}
+
+func (p *termParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *termParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("erlang term: %s at offset %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isAtomChar returns true if the rune can be part of an unquoted atom. Node
+// names (e.g. rabbit@localhost) are included.
+func isAtomChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '@' || r == '.'
+}
+
+// termString returns the string value of an atom, string or binary term.
+func termString(term interface{}) (string, bool) {
+	switch t := term.(type) {
+	case atom:
+		return string(t), true
+	case string:
+		return t, true
+	default:
+		return "", false
+	}
+}
+
+// termStrings returns the string values of a list of atoms, strings or
+// binaries.
+func termStrings(term interface{}) []string {
+	var s []string
+	for _, e := range asList(term) {
+		if v, ok := termString(e); ok {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// proplist returns the value for the given key in an erlang property list
+// (a list of {Key, Value} tuples).
+func proplist(term interface{}, key string) (interface{}, bool) {
+	for _, e := range asList(term) {
+		t, ok := e.(tuple)
+		if !ok || len(t) != 2 {
+			continue
+		}
+
+		if k, ok := t[0].(atom); ok && string(k) == key {
+			return t[1], true
+		}
+	}
+
+	return nil, false
+}
+
+// asList returns the elements of a list term, or nil if the term is not a list.
+func asList(term interface{}) []interface{} {
+	list, _ := term.([]interface{})
+	return list
+}
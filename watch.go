@@ -0,0 +1,336 @@
+package clusterctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Defaults for WatchOptions.
+const (
+	DefaultWatchInterval     = 10 * time.Second
+	DefaultFailureThreshold  = 3
+	DefaultRecoveryThreshold = 2
+	DefaultFailoverCooldown  = 15 * time.Minute
+)
+
+var errCheckTimeout = errors.New("timed out")
+
+// WatchOptions configure a Watcher.
+type WatchOptions struct {
+	// The amount of time between checks of the master. The default is
+	// DefaultWatchInterval. Checking the master, and asking the other
+	// nodes whether they agree that it's down, can each take up to the
+	// interval, so that an unresponsive node or backend doesn't stall the
+	// watcher.
+	Interval time.Duration
+
+	// The number of failed checks before the master is replaced. The
+	// default is DefaultFailureThreshold.
+	FailureThreshold int
+
+	// The number of consecutive successful checks before failed checks
+	// are forgotten, so that a flapping master is still replaced. The
+	// default is DefaultRecoveryThreshold.
+	RecoveryThreshold int
+
+	// The minimum amount of time between failovers. The default is
+	// DefaultFailoverCooldown.
+	Cooldown time.Duration
+
+	// When this file exists, the watcher is paused: the master isn't
+	// checked and won't be replaced.
+	PauseFile string
+
+	// Options for the failover.
+	Failover FailoverOptions
+}
+
+// Watcher periodically checks the master and, when it has failed, promotes a
+// replacement. To avoid split brain, a master that isn't running is only
+// replaced when a majority of the nodes in the cluster (including the master)
+// agree that it's not running, as seen from each node. So that watchers running on several
+// nodes don't fail over at the same time, only the acting watcher fails over:
+// the watcher on the running node, other than the master, with the lowest
+// name.
+type Watcher struct {
+	*Controller
+	options WatchOptions
+
+	// Called with a description of each check that fails, or doesn't
+	// result in a failover. The default is to discard them.
+	Logf func(format string, args ...interface{})
+
+	// The number of failed checks, and the number of consecutive
+	// successful checks since the last failure.
+	failures, successes int
+
+	// The time of the last failover.
+	lastFailover time.Time
+
+	now func() time.Time
+}
+
+// NewWatcher returns a new Watcher for the cluster that the controller's node
+// is a member of.
+func NewWatcher(c *Controller, options WatchOptions) *Watcher {
+	if options.Interval == 0 {
+		options.Interval = DefaultWatchInterval
+	}
+	if options.FailureThreshold == 0 {
+		options.FailureThreshold = DefaultFailureThreshold
+	}
+	if options.RecoveryThreshold == 0 {
+		options.RecoveryThreshold = DefaultRecoveryThreshold
+	}
+	if options.Cooldown == 0 {
+		options.Cooldown = DefaultFailoverCooldown
+	}
+
+	return &Watcher{
+		Controller: c,
+		options:    options,
+		now:        time.Now,
+	}
+}
+
+// Run checks the master every interval until the context is cancelled. f is
+// called with the result of each failover, and the error if it failed.
+func (w *Watcher) Run(ctx context.Context, f func(*OperationResult, error)) {
+	for {
+		if r, err := w.Check(); r != nil || err != nil {
+			f(r, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.options.Interval):
+		}
+	}
+}
+
+// Check checks the master once, and replaces it if it has failed enough checks,
+// the cooldown since the last failover has passed, and this is the acting
+// watcher. A master that isn't running is only replaced when a quorum of nodes
+// agree that it's down. A master that's running, but that the master backend
+// reports as unhealthy (e.g. failing its ELB health checks), is replaced
+// without a vote, since the backend's view is the same from every node. It
+// returns the result of the failover, or nil if there wasn't one.
+func (w *Watcher) Check() (*OperationResult, error) {
+	if w.paused() {
+		w.logf("paused by %s", w.options.PauseFile)
+		return nil, nil
+	}
+
+	var (
+		cluster *ClusterStatus
+		check   masterCheck
+	)
+	err := w.withDeadline(func() (err error) {
+		if cluster, err = w.clusterStatus(w.Node); err != nil {
+			return err
+		}
+		check = w.checkMaster(cluster)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to check the master: %v", err)
+	}
+
+	if check.problem == "" {
+		w.successes++
+		if w.successes >= w.options.RecoveryThreshold {
+			w.failures = 0
+		}
+		return nil, nil
+	}
+
+	w.successes = 0
+	w.failures++
+	w.logf("master check failed (%d/%d): %s", w.failures, w.options.FailureThreshold, check.problem)
+
+	if w.failures < w.options.FailureThreshold {
+		return nil, nil
+	}
+
+	if next := w.lastFailover.Add(w.options.Cooldown); w.now().Before(next) {
+		w.logf("not failing over until the cooldown ends at %s", next.Format(time.RFC3339))
+		return nil, nil
+	}
+
+	master := check.master
+	if master == "" {
+		w.logf("not failing over: nodes can't agree that an unknown master is down")
+		return nil, nil
+	}
+
+	if acting := actingWatcher(cluster, master); acting != w.Node {
+		w.logf("not failing over: %s is the acting watcher", acting)
+		return nil, nil
+	}
+
+	switch {
+	case !check.running:
+		var (
+			votes, required int
+			errs            []error
+		)
+		err = w.withDeadline(func() error {
+			votes, required, errs = w.quorum(cluster, master)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to count the nodes that agree that master %s is down: %v", master, err)
+		}
+
+		for _, err := range errs {
+			w.logf("%v", err)
+		}
+
+		if votes < required {
+			w.logf("not failing over: %d of %d nodes agree that master %s is down, %d required", votes, len(cluster.Nodes()), master, required)
+			return nil, nil
+		}
+	case !check.unhealthy:
+		w.logf("not failing over: the health of master %s is unknown", master)
+		return nil, nil
+	}
+
+	// A failover that fails doesn't start the cooldown, since the master
+	// hasn't been replaced. It's retried once the master has failed
+	// enough checks again.
+	w.failures = 0
+	r, err := w.Failover(w.options.Failover)
+	if r != nil {
+		w.lastFailover = w.now()
+	}
+	return r, err
+}
+
+// masterCheck is the result of checking the master.
+type masterCheck struct {
+	// The master, or an empty string if it can't be determined.
+	master string
+
+	// A description of why the check failed, or an empty string if the
+	// master is healthy.
+	problem string
+
+	// Whether the master is running, as seen from this node, and whether
+	// the master backend reports it as unhealthy.
+	running, unhealthy bool
+}
+
+// checkMaster checks that the master is running and, when the master backend
+// can report it, healthy.
+func (w *Watcher) checkMaster(cluster *ClusterStatus) masterCheck {
+	master, err := w.Master()
+	if err != nil {
+		return masterCheck{problem: fmt.Sprintf("unable to determine the master: %v", err)}
+	}
+
+	if !cluster.IsRunning(master) {
+		return masterCheck{master: master, problem: fmt.Sprintf("master %s is not running", master)}
+	}
+
+	check := masterCheck{master: master, running: true}
+	if checker, ok := unwrapMaster(w.MasterController).(MasterHealthChecker); ok {
+		health, err := checker.MasterHealth()
+		if err != nil {
+			check.problem = fmt.Sprintf("unable to determine the health of master %s: %v", master, err)
+		} else if !health.Healthy {
+			check.problem = fmt.Sprintf("master %s is unhealthy: %s: %s", master, health.State, health.Description)
+			check.unhealthy = true
+		}
+	}
+
+	return check
+}
+
+// quorum returns the number of nodes that see the master as not running, and the
+// number that are required to fail over (a majority of the cluster). Nodes
+// that can't be reached don't vote, and the errors reaching them are returned.
+func (w *Watcher) quorum(cluster *ClusterStatus, master string) (int, int, []error) {
+	required := len(cluster.Nodes())/2 + 1
+
+	var (
+		votes int
+		errs  []error
+	)
+	for _, node := range cluster.RunningNodes {
+		if node == master {
+			continue
+		}
+
+		view := cluster
+		if node != w.Node {
+			var err error
+			if view, err = w.clusterStatus(node); err != nil {
+				errs = append(errs, fmt.Errorf("unable to get the cluster status from %s: %v", node, err))
+				continue
+			}
+		}
+
+		if !view.IsRunning(master) {
+			votes++
+		}
+	}
+
+	return votes, required, errs
+}
+
+// actingWatcher returns the node whose watcher fails over the master: the
+// running node, other than the master, with the lowest name.
+func actingWatcher(cluster *ClusterStatus, master string) string {
+	var acting string
+	for _, node := range cluster.RunningNodes {
+		if node != master && (acting == "" || node < acting) {
+			acting = node
+		}
+	}
+	return acting
+}
+
+func (w *Watcher) clusterStatus(node string) (*ClusterStatus, error) {
+	status, ok := w.MembershipController.(StatusController)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support reporting status", w.MembershipController)
+	}
+
+	return status.ClusterStatus(node)
+}
+
+// withDeadline calls f, and returns errCheckTimeout if it takes longer than the
+// interval. f is left to finish in the background, so it mustn't change the
+// state of the Watcher.
+func (w *Watcher) withDeadline(f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(w.options.Interval):
+		return errCheckTimeout
+	}
+}
+
+func (w *Watcher) paused() bool {
+	if w.options.PauseFile == "" {
+		return false
+	}
+
+	_, err := os.Stat(w.options.PauseFile)
+	return err == nil
+}
+
+func (w *Watcher) logf(format string, args ...interface{}) {
+	if w.Logf != nil {
+		w.Logf(format, args...)
+	}
+}
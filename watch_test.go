@@ -0,0 +1,312 @@
+package clusterctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher_Check(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 2, Cooldown: time.Hour})
+
+	master.On("Master").Return("rabbit@a", nil)
+	master.On("SetMaster", "rabbit@b").Return(nil)
+	for _, node := range []string{"rabbit@b", "rabbit@c"} {
+		m.On("rabbitmqctl", node, "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil)
+	}
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("", nil)
+
+	// The first failure is below the threshold.
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	r, err = w.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@a", r.PreviousMaster)
+	assert.Equal(t, "rabbit@b", r.Master)
+
+	// The master is still reported as rabbit@a, but the cooldown prevents
+	// another failover.
+	for i := 0; i < 2; i++ {
+		r, err = w.Check()
+		assert.NoError(t, err)
+		assert.Nil(t, r)
+	}
+
+	master.AssertNumberOfCalls(t, "SetMaster", 1)
+	m.AssertExpectations(t)
+}
+
+func TestWatcher_Check_NoQuorum(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1})
+
+	var logs []string
+	w.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@b", "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil)
+	m.On("rabbitmqctl", "rabbit@c", "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@a", "rabbit@b", "rabbit@c"), nil)
+
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, []string{
+		"master check failed (1/1): master rabbit@a is not running",
+		"not failing over: 1 of 3 nodes agree that master rabbit@a is down, 2 required",
+	}, logs)
+
+	master.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestWatcher_Check_Cooldown(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1, Cooldown: 15 * time.Minute})
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+
+	var logs []string
+	w.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	// The master stays down, since the mock isn't changed by SetMaster.
+	master.On("Master").Return("rabbit@a", nil)
+	master.On("SetMaster", "rabbit@b").Return(nil)
+	for _, node := range []string{"rabbit@b", "rabbit@c"} {
+		m.On("rabbitmqctl", node, "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil)
+	}
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("", nil)
+
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+
+	// Inside the cooldown.
+	now = now.Add(14 * time.Minute)
+	logs = nil
+	r, err = w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, []string{
+		"master check failed (1/1): master rabbit@a is not running",
+		"not failing over until the cooldown ends at 2020-01-01T00:15:00Z",
+	}, logs)
+
+	// Past the cooldown.
+	now = now.Add(2 * time.Minute)
+	r, err = w.Check()
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+
+	master.AssertNumberOfCalls(t, "SetMaster", 2)
+}
+
+func TestWatcher_Check_FailoverFailed(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1, Cooldown: time.Hour})
+
+	master.On("Master").Return("rabbit@a", nil)
+	master.On("SetMaster", "rabbit@b").Return(errMasterLocked).Once()
+	master.On("SetMaster", "rabbit@b").Return(nil).Once()
+	for _, node := range []string{"rabbit@b", "rabbit@c"} {
+		m.On("rabbitmqctl", node, "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil)
+	}
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("", nil)
+
+	r, err := w.Check()
+	assert.Equal(t, errMasterLocked, err)
+	assert.Nil(t, r)
+
+	// The failed failover didn't start the cooldown, so it's retried.
+	r, err = w.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@b", r.Master)
+
+	master.AssertExpectations(t)
+}
+
+func TestWatcher_Check_Unhealthy(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := &mockHealthMasterController{
+		health: &MasterHealth{Healthy: false, State: "OutOfService", Description: "Instance has failed at least the UnhealthyThreshold number of health checks consecutively."},
+	}
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 2})
+
+	var logs []string
+	w.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	// The master is running, so the other nodes aren't asked whether it's
+	// down: the health reported by the ELB is the same from every node.
+	master.On("Master").Return("rabbit@a", nil)
+	master.On("SetMaster", "rabbit@b").Return(nil)
+	m.On("rabbitmqctl", "rabbit@b", "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@a", "rabbit@b", "rabbit@c"), nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_vhosts", []string{"-q", "name"}).Return("/\n", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_queues", listQueuesArgs("/")).Return("", nil)
+	m.On("rabbitmqctl", "rabbit@b", "list_connections", []string{"-q", "pid"}).Return("", nil)
+
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	r, err = w.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, "rabbit@a", r.PreviousMaster)
+	assert.Equal(t, "rabbit@b", r.Master)
+	assert.Equal(t, []string{
+		"master check failed (1/2): master rabbit@a is unhealthy: OutOfService: Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+		"master check failed (2/2): master rabbit@a is unhealthy: OutOfService: Instance has failed at least the UnhealthyThreshold number of health checks consecutively.",
+	}, logs)
+
+	master.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+func TestWatcher_Check_NotActing(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1})
+	w.Node = "rabbit@c"
+
+	var logs []string
+	w.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@c", "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil)
+
+	// rabbit@b is also running, so its watcher fails over instead.
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, []string{
+		"master check failed (1/1): master rabbit@a is not running",
+		"not failing over: rabbit@b is the acting watcher",
+	}, logs)
+
+	master.AssertNotCalled(t, "SetMaster", "rabbit@b")
+	m.AssertExpectations(t)
+}
+
+func TestWatcher_Check_Hysteresis(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 3, RecoveryThreshold: 2})
+
+	master.On("Master").Return("rabbit@a", nil)
+
+	for _, tt := range []struct {
+		up       bool
+		failures int
+	}{
+		{false, 1},
+		// A single successful check doesn't reset the failures.
+		{true, 1},
+		{false, 2},
+		{true, 2},
+		// RecoveryThreshold consecutive successful checks do.
+		{true, 0},
+	} {
+		status := runningClusterStatus("rabbit@b", "rabbit@c")
+		if tt.up {
+			status = runningClusterStatus("rabbit@a", "rabbit@b", "rabbit@c")
+		}
+		m.On("rabbitmqctl", "rabbit@b", "cluster_status", clusterStatusArgs).Return(status, nil).Once()
+
+		r, err := w.Check()
+		assert.NoError(t, err)
+		assert.Nil(t, r)
+		assert.Equal(t, tt.failures, w.failures)
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestWatcher_Check_Timeout(t *testing.T) {
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1, Interval: 10 * time.Millisecond})
+
+	// The check is abandoned, but finishes in the background.
+	master.On("Master").Return("rabbit@a", nil)
+	m.On("rabbitmqctl", "rabbit@b", "cluster_status", clusterStatusArgs).Return(runningClusterStatus("rabbit@b", "rabbit@c"), nil).After(time.Second)
+
+	start := time.Now()
+	r, err := w.Check()
+	assert.EqualError(t, err, "unable to check the master: timed out")
+	assert.Nil(t, r)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 0, w.failures)
+}
+
+func TestWatcher_Check_Paused(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pauseFile := filepath.Join(dir, "pause")
+	if err := ioutil.WriteFile(pauseFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(mockRabbitmqCtl)
+	master := new(mockMasterController)
+	w := newTestWatcher(m, master, WatchOptions{FailureThreshold: 1, PauseFile: pauseFile})
+
+	r, err := w.Check()
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	master.AssertExpectations(t)
+	m.AssertExpectations(t)
+}
+
+// newTestWatcher returns a Watcher running on rabbit@b, in a cluster of
+// rabbit@a, rabbit@b and rabbit@c.
+func newTestWatcher(m *mockRabbitmqCtl, master MasterController, options WatchOptions) *Watcher {
+	w := NewWatcher(&Controller{
+		Node:                 "rabbit@b",
+		MasterController:     master,
+		MembershipController: &RabbitmqCtlMembershipController{rabbitmqctl: m.rabbitmqctl},
+	}, options)
+	w.now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return w
+}
+
+// runningClusterStatus returns the output of cluster_status for a cluster of
+// rabbit@a, rabbit@b and rabbit@c, where only the given nodes are running.
+func runningClusterStatus(running ...string) string {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"cluster_name":  "rabbit@a",
+		"disk_nodes":    []string{"rabbit@a", "rabbit@b", "rabbit@c"},
+		"ram_nodes":     []string{},
+		"running_nodes": running,
+		"partitions":    map[string][]string{},
+		"alarms":        []interface{}{},
+	})
+	return string(raw)
+}